@@ -10,35 +10,181 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"os"
-	pathpkg "path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 )
 
-func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode build.ImportMode) (_ *build.Package, err error) {
-	// TODO(matloob): dir should be relative to mi. join dir with mi's dir for full directory
-	dir := reldir
+// A DifferentModuleError is returned by ImportPackage for a directory
+// that is in a module nested within the indexed module, rather than in
+// the indexed module itself.
+type DifferentModuleError struct {
+	Dir        string // directory passed to ImportPackage
+	ModuleRoot string // root directory of the nested module
+}
+
+func (e *DifferentModuleError) Error() string {
+	return fmt.Sprintf("directory %s is in a different module, rooted at %s", e.Dir, e.ModuleRoot)
+}
+
+// ImportPackage is like ctxt.ImportDir, but reads the package from the
+// index instead of the file system. dir is the package's directory relative
+// to the module root (such as "" or "internal/foo"), its absolute directory
+// under the directory the index was opened against, or its full import path.
+// Directories in modules nested within the indexed module aren't part of
+// the index; for them, ImportPackage returns a *DifferentModuleError.
+func (mi *ModuleIndex) ImportPackage(ctxt build.Context, dir string, mode build.ImportMode) (*build.Package, error) {
+	pkgs, errs := mi.ImportPackageMulti([]build.Context{ctxt}, dir, mode)
+	return pkgs[0], errs[0]
+}
 
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("error reading module index: %v", e)
+// ImportPackageMulti is like calling ImportPackage for each of ctxts, but
+// reads the package and its files from the index only once. The package
+// and error for ctxts[i] are returned in the ith elements of the results.
+func (mi *ModuleIndex) ImportPackageMulti(ctxts []build.Context, dir string, mode build.ImportMode) ([]*build.Package, []error) {
+	pkgs := make([]*build.Package, len(ctxts))
+	errs := make([]error, len(ctxts))
+	all := func(p *build.Package, err error) ([]*build.Package, []error) {
+		for i := range ctxts {
+			pkgs[i], errs[i] = p, err
+			if p != nil && i > 0 {
+				p1 := *p
+				pkgs[i] = &p1
+			}
 		}
-	}()
+		return pkgs, errs
+	}
 
-	rp, ok := mi.RawPackage(dir)
-	if !ok {
-		return &build.Package{
+	rp, ok, err := mi.RawPackage(dir)
+	if err != nil {
+		return all(nil, err)
+	} else if !ok {
+		return all(&build.Package{
 			ImportPath: ".",
 			Dir:        dir,
-		}, fmt.Errorf("cannot find package . in:\n\t%s", dir)
+		}, mi.notFoundError(dir))
+	}
+
+	var files []*rawFile
+	if rp.Error == "" && mode&build.FindOnly == 0 {
+		files = make([]*rawFile, len(rp.SourceFiles))
+		for i := range rp.SourceFiles {
+			if files[i], err = readRawFile(&rp.SourceFiles[i]); err != nil {
+				return all(mi.newPackage(rp), err)
+			}
+		}
+	}
+	for i, ctxt := range ctxts {
+		pkgs[i], errs[i] = mi.importPackage(ctxt, rp, files, mode)
+	}
+	return pkgs, errs
+}
+
+// notFoundError returns the error for a directory that isn't in the index.
+func (mi *ModuleIndex) notFoundError(dir string) error {
+	if root, ok := mi.nestedModule(dir); ok {
+		return &DifferentModuleError{Dir: dir, ModuleRoot: filepath.Join(mi.moddir, filepath.FromSlash(root))}
+	}
+	return fmt.Errorf("cannot find package . in:\n\t%s", dir)
+}
+
+// A rawFile holds the fields of a SourceFile, decoded from the index once
+// so that the file can be evaluated against any number of build contexts.
+type rawFile struct {
+	name                    string
+	error                   string
+	parseError              string
+	synopsis                string
+	pkgName                 string
+	ignoreFile              bool
+	binaryOnly              bool
+	quotedImportComment     string
+	quotedImportCommentLine int
+	constraints             parsedConstraints
+	imports                 []TFImport
+	embeds                  []embed
+}
+
+// readRawFile decodes the source file record of sf. The fields are read
+// in a single pass, in the order they are encoded, rather than through
+// the SourceFile accessors: in the compact encoding, each accessor has
+// to skip over all the fields before its own.
+func readRawFile(sf *SourceFile) (*rawFile, error) {
+	var f rawFile
+	d := decoderAt{pos: sf.offset, mi: sf.mi}
+	f.error = d.string()
+	f.parseError = d.string()
+	f.synopsis = d.string()
+	f.name = d.string()
+	f.pkgName = d.string()
+	if sf.mi.compact {
+		flags := d.int()
+		f.ignoreFile = flags&sourceFileFlagIgnoreFile != 0
+		f.binaryOnly = flags&sourceFileFlagBinaryOnly != 0
+	} else {
+		f.ignoreFile = d.bool()
+		f.binaryOnly = d.bool()
+	}
+	f.quotedImportComment = d.string()
+	f.quotedImportCommentLine = d.int()
+	goBuild := d.string()
+	var plusBuild []string
+	numPlusBuild := d.count(1)
+	for i := 0; i < numPlusBuild; i++ {
+		plusBuild = append(plusBuild, d.string())
+	}
+
+	filename := filepath.Join(sf.dir, f.name)
+	numImports := d.count(5)
+	for i := 0; i < numImports; i++ {
+		path := d.string()
+		doc := d.string()
+		f.imports = append(f.imports, TFImport{
+			Path:     path,
+			Doc:      doc,
+			Position: d.tokpos(filename),
+		})
+	}
+	d.prevOffset, d.prevLine = 0, 0 // embed positions are a new list
+	numEmbeds := d.count(4)
+	for i := 0; i < numEmbeds; i++ {
+		pattern := d.string()
+		f.embeds = append(f.embeds, embed{pattern, d.tokpos(filename)})
+	}
+
+	if sf.mi.version >= Version6 {
+		f.constraints = d.constraints()
+	} else {
+		f.constraints = parseConstraints(f.name, goBuild, plusBuild)
 	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &f, nil
+}
 
+// newPackage returns the build.Package for rp before any of its files
+// have been evaluated.
+func (mi *ModuleIndex) newPackage(rp *RawPackage2) *build.Package {
 	p := &build.Package{
 		ImportPath: rp.Path,
 		Dir:        rp.SrcDir,
 	}
+	// Like the go command in module mode, report the module root as Root
+	// if the package's import path is known. SrcRoot, PkgRoot, BinDir,
+	// PkgTargetRoot and PkgObj are specific to GOPATH mode and are left
+	// unset. Goroot is always false: indexes don't hold GOROOT packages.
+	if mi.ModulePath() != "" {
+		p.Root = mi.moddir
+	}
+	return p
+}
+
+// importPackage evaluates the package rp, whose decoded files are files,
+// for ctxt. files is nil if rp.Error is set or mode includes FindOnly.
+func (mi *ModuleIndex) importPackage(ctxt build.Context, rp *RawPackage2, files []*rawFile, mode build.ImportMode) (*build.Package, error) {
+	p := mi.newPackage(rp)
 	if rp.Error != "" {
 		return p, errors.New(rp.Error)
 	}
@@ -46,58 +192,20 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 	const path = "." // TODO(matloob): clean this up; ImportDir calls ctxt.Import with path == "."
 	srcDir := rp.SrcDir
 
-	var pkgtargetroot string
-	var pkga string
 	var pkgerr error
-	suffix := ""
-	if ctxt.InstallSuffix != "" {
-		suffix = "_" + ctxt.InstallSuffix
-	}
 	switch ctxt.Compiler {
-	case "gccgo":
-		pkgtargetroot = "pkg/gccgo_" + ctxt.GOOS + "_" + ctxt.GOARCH + suffix
-	case "gc":
-		pkgtargetroot = "pkg/" + ctxt.GOOS + "_" + ctxt.GOARCH + suffix
+	case "gccgo", "gc":
 	default:
 		// Save error for end of function.
 		pkgerr = fmt.Errorf("import %q: unknown compiler %q", path, ctxt.Compiler)
 	}
-	setPkga := func() {
-		switch ctxt.Compiler {
-		case "gccgo":
-			dir, elem := pathpkg.Split(p.ImportPath)
-			pkga = pkgtargetroot + "/" + dir + "lib" + elem + ".a"
-		case "gc":
-			pkga = pkgtargetroot + "/" + p.ImportPath + ".a"
-		}
-	}
-	setPkga()
 
-	pkga = "" // local imports have no installed path
 	if srcDir == "" {
 		return p, fmt.Errorf("import %q: import relative to unknown directory", path)
 	}
 	if !isAbsPath(path) {
 		p.Dir = joinPath(srcDir, path)
 	}
-	// p.Dir directory may or may not exist. Gather partial information first, check if it exists later.
-	// Determine canonical import path, if any.
-	// Exclude results where the import path would include /testdata/.
-
-	// Assumption: directory is in the module cache.
-
-	// It's okay that we didn't find a root containing dir.
-	// Keep going with the information we have.
-
-	if p.Root != "" {
-		p.SrcRoot = joinPath(p.Root, "src")
-		p.PkgRoot = joinPath(p.Root, "pkg")
-		p.BinDir = joinPath(p.Root, "bin")
-		if pkga != "" {
-			p.PkgTargetRoot = joinPath(p.Root, pkgtargetroot)
-			p.PkgObj = joinPath(p.Root, pkga)
-		}
-	}
 
 	if mode&build.FindOnly != 0 {
 		return p, pkgerr
@@ -125,13 +233,13 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 	testImportPos := make(map[string][]token.Position)
 	xTestImportPos := make(map[string][]token.Position)
 	allTags := make(map[string]bool)
-	for _, tf := range rp.SourceFiles {
-		name := tf.name()
-		if error := tf.error(); error != "" {
-			badFile(name, errors.New(tf.error()))
+	for _, tf := range files {
+		name := tf.name
+		if tf.error != "" {
+			badFile(name, errors.New(tf.error))
 			continue
-		} else if parseError := tf.parseError(); parseError != "" {
-			badFile(name, errors.New(tf.parseError()))
+		} else if tf.parseError != "" {
+			badFile(name, errors.New(tf.parseError))
 			// Fall through: we might still have a partial AST in info.parsed,
 			// and we want to list files with parse errors anyway.
 		}
@@ -139,24 +247,21 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 		var shouldBuild = true
 		if !goodOSArchFile(ctxt, name, allTags) && !ctxt.UseAllFiles {
 			shouldBuild = false
-		} else if goBuildConstraint := tf.goBuildConstraint(); goBuildConstraint != "" {
-			x, err := constraint.Parse(goBuildConstraint)
-			if err != nil {
-				return nil, fmt.Errorf("%s: parsing //go:build line: %v", name, err)
-			}
-			shouldBuild = eval(ctxt, x, allTags)
-		} else if plusBuildConstraints := tf.plusBuildConstraints(); len(plusBuildConstraints) > 0 {
-			for _, text := range plusBuildConstraints {
-				if x, err := constraint.Parse(text); err == nil {
-					if !eval(ctxt, x, allTags) {
-						shouldBuild = false
-					}
+		} else if c := &tf.constraints; c.err != "" {
+			badFile(name, errors.New(c.err))
+			continue
+		} else if c.goBuild != nil {
+			shouldBuild = eval(ctxt, c.goBuild, allTags)
+		} else {
+			for _, x := range c.plusBuild {
+				if !eval(ctxt, x, allTags) {
+					shouldBuild = false
 				}
 			}
 		}
 
 		ext := nameExt(name)
-		if !shouldBuild || tf.ignoreFile() {
+		if !shouldBuild || tf.ignoreFile {
 			if strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
 				// not due to build constraints - don't report
 			} else if ext == ".go" {
@@ -184,26 +289,26 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 
 		// TODO(matloob): determine pkg name here? pkg variable
 
-		pkg := tf.pkgName()
+		pkg := tf.pkgName
 		if pkg == "documentation" {
 			p.IgnoredGoFiles = append(p.IgnoredGoFiles, name)
 			continue
 		}
 		isTest := strings.HasSuffix(name, "_test.go")
 		isXTest := false
-		if isTest && strings.HasSuffix(tf.pkgName(), "_test") && p.Name != tf.pkgName() {
+		if isTest && strings.HasSuffix(pkg, "_test") && p.Name != pkg {
 			isXTest = true
 			pkg = pkg[:len(pkg)-len("_test")]
 		}
 
-		if !isTest && tf.binaryOnly() {
+		if !isTest && tf.binaryOnly {
 			p.BinaryOnly = true
 		}
 
 		// Grab the first package comment as docs, provided it is not from a test file.
 		if p.Doc == "" && !isTest && !isXTest {
-			if synopsis := tf.synopsis(); synopsis != "" {
-				p.Doc = synopsis
+			if tf.synopsis != "" {
+				p.Doc = tf.synopsis
 			}
 		}
 
@@ -222,9 +327,10 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 		}
 
 		if mode&build.ImportComment != 0 {
-			com, err := strconv.Unquote(tf.quotedImportComment())
+			line := tf.quotedImportCommentLine
+			com, err := strconv.Unquote(tf.quotedImportComment)
 			if err != nil {
-				badFile(name, fmt.Errorf("%s:%d: cannot parse import comment", name, tf.quotedImportCommentLine()))
+				badFile(name, fmt.Errorf("%s:%d: cannot parse import comment", name, line))
 			} else if p.ImportComment == "" {
 				p.ImportComment = com
 				firstCommentFile = name
@@ -235,8 +341,7 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 
 		// Record imports and information about cgo.
 		isCgo := false
-		imports := tf.imports()
-		for _, imp := range imports {
+		for _, imp := range tf.imports {
 			if imp.Path == "C" {
 				if isTest {
 					badFile(name, fmt.Errorf("use of cgo in test %s not supported", name))
@@ -281,12 +386,12 @@ func (mi *ModuleIndex) ImportPackage(ctxt build.Context, reldir string, mode bui
 		}
 		*fileList = append(*fileList, name)
 		if importMap != nil {
-			for _, imp := range imports {
+			for _, imp := range tf.imports {
 				importMap[imp.Path] = append(importMap[imp.Path], imp.Position)
 			}
 		}
 		if embedMap != nil {
-			for _, e := range tf.embeds() {
+			for _, e := range tf.embeds {
 				embedMap[e.pattern] = append(embedMap[e.pattern], e.position)
 			}
 		}
@@ -504,6 +609,55 @@ func matchAuto(ctxt build.Context, text string, allTags map[string]bool) bool {
 	return eval(ctxt, x, allTags)
 }
 
+// parsedConstraints holds the build constraints of a source file, parsed
+// once when the file is indexed so that evaluating them is a tree walk.
+type parsedConstraints struct {
+	err       string            // error parsing the //go:build line, if any
+	goBuild   constraint.Expr   // the //go:build line, or nil if there is none
+	plusBuild []constraint.Expr // the valid // +build lines, if there's no //go:build line
+	tags      []string          // tags mentioned in goBuild and plusBuild, sorted
+}
+
+// parseConstraints parses the build constraint lines of the file with the
+// given name. As with go/build, an invalid //go:build line is an error,
+// but invalid // +build lines are ignored, as are // +build lines in a
+// file with a //go:build line.
+func parseConstraints(name, goBuild string, plusBuild []string) parsedConstraints {
+	var c parsedConstraints
+	if goBuild != "" {
+		x, err := constraint.Parse(goBuild)
+		if err != nil {
+			c.err = fmt.Sprintf("%s: parsing //go:build line: %v", name, err)
+			return c
+		}
+		c.goBuild = x
+	} else {
+		for _, text := range plusBuild {
+			if x, err := constraint.Parse(text); err == nil {
+				c.plusBuild = append(c.plusBuild, x)
+			}
+		}
+	}
+
+	tags := make(map[string]bool)
+	mention := func(tag string) bool {
+		tags[tag] = true
+		return true
+	}
+	// Eval evaluates both operands of every operator, so it visits every tag.
+	if c.goBuild != nil {
+		c.goBuild.Eval(mention)
+	}
+	for _, x := range c.plusBuild {
+		x.Eval(mention)
+	}
+	for tag := range tags {
+		c.tags = append(c.tags, tag)
+	}
+	sort.Strings(c.tags)
+	return c
+}
+
 func eval(ctxt build.Context, x constraint.Expr, allTags map[string]bool) bool {
 	return x.Eval(func(tag string) bool { return matchTag(ctxt, tag, allTags) })
 }
@@ -562,6 +716,18 @@ func matchTag(ctxt build.Context, name string, allTags map[string]bool) bool {
 }
 
 func goodOSArchFile(ctxt build.Context, name string, allTags map[string]bool) bool {
+	for _, tag := range osArchFileTags(name) {
+		if !matchTag(ctxt, tag, allTags) {
+			return false
+		}
+	}
+	return true
+}
+
+// osArchFileTags returns the GOOS and GOARCH tags implied by the file
+// name, in the order goodOSArchFile consults them: the architecture
+// before the operating system.
+func osArchFileTags(name string) []string {
 	name, _, _ = strings.Cut(name, ".")
 
 	// Before Go 1.4, a file called "linux.go" would be equivalent to having a
@@ -573,7 +739,7 @@ func goodOSArchFile(ctxt build.Context, name string, allTags map[string]bool) bo
 	// in the name before the initial _.
 	i := strings.Index(name, "_")
 	if i < 0 {
-		return true
+		return nil
 	}
 	name = name[i:] // ignore everything before first _
 
@@ -583,10 +749,38 @@ func goodOSArchFile(ctxt build.Context, name string, allTags map[string]bool) bo
 	}
 	n := len(l)
 	if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
-		return matchTag(ctxt, l[n-1], allTags) && matchTag(ctxt, l[n-2], allTags)
+		return []string{l[n-1], l[n-2]}
 	}
 	if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
-		return matchTag(ctxt, l[n-1], allTags)
+		return []string{l[n-1]}
 	}
-	return true
+	return nil
+}
+
+// mentionedTags returns the build tags mentioned by the file with the
+// given name and build constraints, regardless of build context: the
+// tags implied by its name, the tags in its constraints, and "cgo" if
+// it imports "C". Files go/build never considers, whose names begin
+// with "_" or ".", mention no tags. The result is sorted.
+func mentionedTags(name string, c *parsedConstraints, importsC bool) []string {
+	if strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+		return nil
+	}
+	tags := append(osArchFileTags(name), c.tags...)
+	if importsC {
+		tags = append(tags, "cgo")
+	}
+	return sortedUnique(tags)
+}
+
+// sortedUnique sorts tags and removes duplicates, in place.
+func sortedUnique(tags []string) []string {
+	sort.Strings(tags)
+	out := tags[:0]
+	for i, tag := range tags {
+		if i == 0 || tag != tags[i-1] {
+			out = append(out, tag)
+		}
+	}
+	return out
 }
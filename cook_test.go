@@ -0,0 +1,100 @@
+package index
+
+import (
+	"errors"
+	"go/build"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestNestedModule checks that ImportPackage reports directories in a
+// nested module as belonging to a different module.
+func TestNestedModule(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"nested"}; !reflect.DeepEqual(rm.Nested, want) {
+		t.Errorf("Nested = %q, want %q", rm.Nested, want)
+	}
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+
+	root := filepath.Join(moddir, "nested")
+	for _, dir := range []string{"nested", "nested/x", "example.com/m/nested", root} {
+		_, err := mi.ImportPackage(build.Default, dir, 0)
+		var dme *DifferentModuleError
+		if !errors.As(err, &dme) {
+			t.Errorf("ImportPackage(%q) error = %v, want *DifferentModuleError", dir, err)
+			continue
+		}
+		if dme.Dir != dir || dme.ModuleRoot != root {
+			t.Errorf("ImportPackage(%q) error = %+v, want Dir %s, ModuleRoot %s", dir, dme, dir, root)
+		}
+	}
+}
+
+// TestImportPackageMulti checks that ImportPackageMulti gives the same
+// results as calling ImportPackage for each context, including for
+// directories that aren't in the index and in FindOnly mode.
+func TestImportPackageMulti(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	ctxts := testContexts()
+	dirs := append([]string{"missing", "nested"}, testPackageDirs...)
+	for _, opts := range testEncodeOptions {
+		mi := openTestIndex(t, encodeTestIndex(t, moddir, opts), moddir)
+		for _, mode := range []build.ImportMode{0, build.ImportComment, build.FindOnly} {
+			for _, dir := range dirs {
+				pkgs, errs := mi.ImportPackageMulti(ctxts, dir, mode)
+				if len(pkgs) != len(ctxts) || len(errs) != len(ctxts) {
+					t.Fatalf("ImportPackageMulti(%q) returned %d packages and %d errors for %d contexts", dir, len(pkgs), len(errs), len(ctxts))
+				}
+				for i, ctxt := range ctxts {
+					p, err := mi.ImportPackage(ctxt, dir, mode)
+					if !reflect.DeepEqual(pkgs[i], p) || !reflect.DeepEqual(errs[i], err) {
+						t.Errorf("%s: ImportPackageMulti(%q, %v)[%s/%s cgo=%v] = %+v, %v; want %+v, %v",
+							encodingName(opts), dir, mode, ctxt.GOOS, ctxt.GOARCH, ctxt.CgoEnabled, pkgs[i], errs[i], p, err)
+					}
+				}
+				for i := 1; i < len(pkgs); i++ {
+					if pkgs[i] == pkgs[0] {
+						t.Errorf("%s: ImportPackageMulti(%q, %v) shares a package between contexts", encodingName(opts), dir, mode)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestImportPath checks that ImportPackage reports the import path and
+// root of a package when the index records the module path, and "." and
+// no root when it doesn't.
+func TestImportPath(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+	p, err := mi.ImportPackage(build.Default, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ImportPath != "example.com/m/a" || p.Root != moddir {
+		t.Errorf("with module path: ImportPath = %q, Root = %q; want %q, %q", p.ImportPath, p.Root, "example.com/m/a", moddir)
+	}
+
+	data, err := EncodeModule(testPackages(t, moddir), moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi = openTestIndex(t, data, moddir)
+	p, err = mi.ImportPackage(build.Default, "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ImportPath != "." || p.Root != "" {
+		t.Errorf("without module path: ImportPath = %q, Root = %q; want %q, %q", p.ImportPath, p.Root, ".", "")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package index
+
+// syncDir is not supported on this platform: directories can't be opened
+// and synced portably. A file renamed into dir may not survive a crash.
+func syncDir(dir string) error {
+	return nil
+}
@@ -2,15 +2,22 @@ package index
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go/build/constraint"
 	"go/doc"
 	"go/token"
 	"io/fs"
-	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
 )
 
 type TaggedFile struct {
@@ -56,23 +63,241 @@ type RawPackage struct {
 }
 
 type RawModule struct {
-	Dirs map[string]*RawPackage
+	Path    string     // module path from go.mod, if any
+	Version string     // module version, if known; IndexModule doesn't set it
+	GoMod   *GoModInfo // the module's go.mod file, if it has one that can be parsed
+	Dirs    map[string]*RawPackage
+	Nested  []string // directories of nested modules, which aren't indexed
+}
+
+// GoModInfo holds the contents of a go.mod file along with a summary of
+// the parts of it that affect how the module's packages are built.
+type GoModInfo struct {
+	Data    []byte           // contents of the go.mod file
+	Module  string           // module path
+	Go      string           // version from the go directive, if any
+	Require []module.Version // requirements, in the order they appear
+}
+
+// parseGoMod parses the go.mod file with the given name and contents.
+func parseGoMod(file string, data []byte) (*GoModInfo, error) {
+	f, err := modfile.ParseLax(file, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	gomod := &GoModInfo{Data: data}
+	if f.Module != nil {
+		gomod.Module = f.Module.Mod.Path
+	}
+	if f.Go != nil {
+		gomod.Go = f.Go.Version
+	}
+	for _, r := range f.Require {
+		gomod.Require = append(gomod.Require, r.Mod)
+	}
+	return gomod, nil
+}
+
+// packages returns the packages of the module, in no particular order.
+func (rm *RawModule) packages() []*RawPackage {
+	packages := make([]*RawPackage, 0, len(rm.Dirs))
+	for _, p := range rm.Dirs {
+		packages = append(packages, p)
+	}
+	return packages
+}
+
+// IndexOptions controls which directories IndexModuleWithOptions indexes.
+// By default, it follows the go command's rules for which directories
+// "./..." matches within a module, pruning directories named testdata or
+// vendor and directories whose names begin with "." or "_".
+type IndexOptions struct {
+	IncludeVendor   bool // index vendor directories, as for vendor-mode builds
+	IncludeTestdata bool // index testdata directories
+	IncludeIgnored  bool // index directories whose names begin with "." or "_"
+
+	// Workers is the maximum number of directories and files to read
+	// and parse concurrently. If it is zero, runtime.GOMAXPROCS(0) is
+	// used. The resulting index doesn't depend on the number of workers.
+	Workers int
+}
+
+// prune reports whether the directory with the given name, which isn't
+// the module root, should be left out of the index.
+func (opts IndexOptions) prune(name string) bool {
+	switch {
+	case name == "vendor":
+		return !opts.IncludeVendor
+	case name == "testdata":
+		return !opts.IncludeTestdata
+	case strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_"):
+		return !opts.IncludeIgnored
+	}
+	return false
 }
 
+// IndexModule indexes the packages of the module rooted at dir
+// using the default IndexOptions.
 func IndexModule(dir string) (*RawModule, error) {
+	return IndexModuleWithOptions(dir, IndexOptions{})
+}
+
+// IndexModuleWithOptions is like IndexModule but indexes the
+// directories selected by opts.
+func IndexModuleWithOptions(dir string, opts IndexOptions) (*RawModule, error) {
+	return indexFS(os.DirFS(dir), ".", dir, opts)
+}
+
+// IndexFS is like IndexModule, but indexes the module rooted at the
+// directory root within fsys, such as a module zip file or an embed.FS.
+// The directories of the resulting packages are within root, so the
+// module should be encoded with root, in operating system form, as its
+// module directory.
+func IndexFS(fsys fs.FS, root string) (*RawModule, error) {
+	return IndexFSWithOptions(fsys, root, IndexOptions{})
+}
+
+// IndexFSWithOptions is like IndexFS but indexes the directories
+// selected by opts.
+func IndexFSWithOptions(fsys fs.FS, root string, opts IndexOptions) (*RawModule, error) {
+	return indexFS(fsys, root, filepath.FromSlash(root), opts)
+}
+
+// indexFS indexes the module rooted at the directory root within fsys.
+// osroot is the name of root reported in package directories, file
+// names and errors.
+func indexFS(fsys fs.FS, root, osroot string, opts IndexOptions) (*RawModule, error) {
 	rm := &RawModule{Dirs: make(map[string]*RawPackage)}
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+	var rels, fsdirs, dirs []string // directories to index
+	gomodFile := filepath.Join(osroot, "go.mod")
+	if data, err := fs.ReadFile(fsys, path.Join(root, "go.mod")); err == nil {
+		// A go.mod file that can't be parsed doesn't stop the module's
+		// packages from being indexed, but only its module path, if it
+		// has one, is recorded.
+		if rm.GoMod, err = parseGoMod(gomodFile, data); err == nil {
+			rm.Path = rm.GoMod.Module
+		} else {
+			rm.Path = modfile.ModulePath(data)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, osPathError(err, gomodFile)
+	}
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		rel := ""
+		if name != root {
+			rel = strings.TrimPrefix(name, root+"/")
+			if root == "." {
+				rel = name
+			}
+		}
+		dir := filepath.Join(osroot, filepath.FromSlash(rel))
 		if err != nil {
-			return err
+			return osPathError(err, dir)
 		}
 		if !d.IsDir() {
 			return nil
 		}
-		rel := strings.TrimPrefix(filepath.ToSlash(path[len(dir):]), "/")
-		rm.Dirs[rel] = ImportDirRaw(path)
+		if name != root {
+			if opts.prune(d.Name()) {
+				return fs.SkipDir
+			}
+			// A directory with its own go.mod file is the root of a
+			// different module. Record it, but leave it unindexed.
+			if fi, err := fs.Stat(fsys, path.Join(name, "go.mod")); err == nil && !fi.IsDir() {
+				rm.Nested = append(rm.Nested, rel)
+				return fs.SkipDir
+			}
+		}
+		rels = append(rels, rel)
+		fsdirs = append(fsdirs, name)
+		dirs = append(dirs, dir)
 		return nil
 	})
-	return rm, err
+	if err != nil {
+		return rm, err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for i, p := range importDirsRaw(fsys, fsdirs, dirs, workers) {
+		rm.Dirs[rels[i]] = p
+	}
+	return rm, nil
+}
+
+// osPathError returns err, with its path replaced by name if it is an
+// *fs.PathError, so that errors name files as they're reported in the
+// index rather than as they're named within an fs.FS.
+func osPathError(err error, name string) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return &fs.PathError{Op: pe.Op, Path: name, Err: pe.Err}
+	}
+	return err
+}
+
+// importDirsRaw is like calling ImportDirRaw for each of dirs, but reads
+// each directory from the corresponding directory of fsdirs within fsys,
+// and reads the directories, and then parses their files, using up to
+// workers goroutines. The files of each package are in the same order as
+// ImportDirRaw would produce.
+func importDirsRaw(fsys fs.FS, fsdirs, dirs []string, workers int) []*RawPackage {
+	pkgs := make([]*RawPackage, len(dirs))
+	entries := make([][]fs.DirEntry, len(dirs))
+	files := make([][]*TaggedFile, len(dirs))
+	parallel(workers, len(dirs), func(i int) {
+		pkgs[i] = &RawPackage{
+			Path:   ".",
+			SrcDir: dirs[i],
+			Dir:    filepath.Join(dirs[i], "."),
+		}
+		entries[i] = readDirFS(pkgs[i], fsys, fsdirs[i])
+		files[i] = make([]*TaggedFile, len(entries[i]))
+	})
+
+	type fileJob struct{ pkg, file int }
+	var jobs []fileJob
+	for i := range entries {
+		for j := range entries[i] {
+			jobs = append(jobs, fileJob{i, j})
+		}
+	}
+	parallel(workers, len(jobs), func(k int) {
+		job := jobs[k]
+		files[job.pkg][job.file] = importFileRaw(fsys, fsdirs[job.pkg], pkgs[job.pkg].Dir, entries[job.pkg][job.file])
+	})
+
+	for i, p := range pkgs {
+		for _, tf := range files[i] {
+			if tf != nil {
+				p.SourceFiles = append(p.SourceFiles, tf)
+			}
+		}
+	}
+	return pkgs
+}
+
+// parallel calls f(i) for each i in [0, n), using up to workers goroutines.
+func parallel(workers, n int, f func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
 }
 
 func ImportDirRaw(dir string) *RawPackage {
@@ -95,7 +320,50 @@ func ImportDirRaw(dir string) *RawPackage {
 // If an error occurs, Import returns a non-nil error and a non-nil
 // *Package containing partial information.
 //
+// ImportRaw can't resolve non-local import paths, and returns a package
+// with Error set for them; see ImportRawWithOptions.
+//
 func ImportRaw(path string, srcDir string) *RawPackage {
+	return ImportRawWithOptions(path, srcDir, ImportRawOptions{})
+}
+
+// ImportRawOptions controls how ImportRawWithOptions resolves non-local
+// import paths.
+type ImportRawOptions struct {
+	// ModuleRoot and ModulePath are the root directory and module path of
+	// the module that import paths within ModulePath are resolved in.
+	ModuleRoot string
+	ModulePath string
+
+	// GOROOT, if set, is the Go root that standard library import paths,
+	// whose first element contains no dot, are resolved in.
+	GOROOT string
+}
+
+// resolve returns the directory holding the package with the non-local
+// import path, or false if the package isn't in the module or GOROOT.
+func (opts ImportRawOptions) resolve(path string) (dir string, ok bool) {
+	if opts.ModulePath != "" && opts.ModuleRoot != "" {
+		if path == opts.ModulePath {
+			return opts.ModuleRoot, true
+		}
+		if strings.HasPrefix(path, opts.ModulePath+"/") {
+			return filepath.Join(opts.ModuleRoot, filepath.FromSlash(path[len(opts.ModulePath)+1:])), true
+		}
+	}
+	if opts.GOROOT != "" {
+		if elem, _, _ := strings.Cut(path, "/"); !strings.Contains(elem, ".") {
+			return filepath.Join(opts.GOROOT, "src", filepath.FromSlash(path)), true
+		}
+	}
+	return "", false
+}
+
+// ImportRawWithOptions is like ImportRaw, but resolves non-local import
+// paths in the module and Go root given by opts. The package is read from
+// the directory the import path resolves to; if it doesn't resolve to a
+// directory, the returned package has Error set.
+func ImportRawWithOptions(path string, srcDir string, opts ImportRawOptions) *RawPackage {
 	p := &RawPackage{
 		Path:   path,
 		SrcDir: srcDir,
@@ -106,7 +374,23 @@ func ImportRaw(path string, srcDir string) *RawPackage {
 	}
 
 	if !IsLocalImport(path) {
-		panic(path)
+		if err := module.CheckImportPath(path); err != nil {
+			p.Error = fmt.Errorf("import %q: invalid import path: %v", path, err).Error()
+			return p
+		}
+		dir, ok := opts.resolve(path)
+		if !ok {
+			where := "any module"
+			if opts.ModulePath != "" {
+				where = "module " + opts.ModulePath
+			}
+			if opts.GOROOT != "" {
+				where += " or GOROOT"
+			}
+			p.Error = fmt.Errorf("import %q: package is not in %s", path, where).Error()
+			return p
+		}
+		p.Dir = dir
 	} else {
 		if srcDir == "" {
 			p.Error = fmt.Errorf("import %q: import relative to unknown directory", path).Error()
@@ -117,96 +401,109 @@ func ImportRaw(path string, srcDir string) *RawPackage {
 		}
 	}
 
-	// If it's a local import path, by the time we get here, we still haven't checked
+	fsys := os.DirFS(p.Dir)
+	for _, d := range readDirFS(p, fsys, ".") {
+		if tf := importFileRaw(fsys, ".", p.Dir, d); tf != nil {
+			p.SourceFiles = append(p.SourceFiles, tf)
+		}
+	}
+	return p
+}
+
+// readDirFS returns the entries of the directory fsdir within fsys, which
+// holds the package p. If the directory can't be read, readDirFS sets
+// p.Error and returns no entries.
+func readDirFS(p *RawPackage, fsys fs.FS, fsdir string) []fs.DirEntry {
+	// By the time we get here, we still haven't checked
 	// that p.Dir directory exists. This is the right time to do that check.
 	// We can't do it earlier, because we want to gather partial information for the
 	// non-nil *Package returned when an error occurs.
 	// We need to do this before we return early on FindOnly flag.
-	if IsLocalImport(path) && !isDir(p.Dir) {
+	if !isDir(fsys, fsdir) {
 		// package was not found
-		p.Error = fmt.Errorf("cannot find package %q in:\n\t%s", path, p.Dir).Error()
-		return p
+		p.Error = fmt.Errorf("cannot find package %q in:\n\t%s", p.Path, p.Dir).Error()
+		return nil
 	}
 
-	// TODO: use os.ReadDir
-	dirs, err := ioutil.ReadDir(p.Dir)
+	entries, err := fs.ReadDir(fsys, fsdir)
 	if err != nil {
-		p.Error = err.Error()
-		return p
+		p.Error = osPathError(err, p.Dir).Error()
+		return nil
 	}
+	return entries
+}
 
-	fset := token.NewFileSet()
-	for _, d := range dirs {
-		if d.IsDir() {
-			continue
-		}
-		if d.Mode()&fs.ModeSymlink != 0 {
-			if isDir(filepath.Join(p.Dir, d.Name())) {
-				// Symlinks to directories are not source files.
-				continue
-			}
+// importFileRaw returns the TaggedFile for the entry d of the package
+// directory dir, which is read from the directory fsdir within fsys.
+// It returns nil if d is a directory or a symlink to one. Each file is
+// parsed with its own token.FileSet, so importFileRaw may be called for
+// several files concurrently.
+func importFileRaw(fsys fs.FS, fsdir, dir string, d fs.DirEntry) *TaggedFile {
+	if d.IsDir() {
+		return nil
+	}
+	if d.Type()&fs.ModeSymlink != 0 {
+		if isDir(fsys, path.Join(fsdir, d.Name())) {
+			// Symlinks to directories are not source files.
+			return nil
 		}
+	}
 
-		name := d.Name()
-		ext := nameExt(name)
+	name := d.Name()
+	ext := nameExt(name)
 
-		info, err := getInfo(p.Dir, name, fset)
-		if err != nil {
-			p.SourceFiles = append(p.SourceFiles, &TaggedFile{Name: name, Error: err.Error()})
-			continue
-		} else if info == nil {
-			p.SourceFiles = append(p.SourceFiles, &TaggedFile{Name: name, IgnoreFile: true})
-			continue
-		}
-		tf := &TaggedFile{
-			Name:                 name,
-			GoBuildConstraint:    info.goBuildConstraint,
-			PlusBuildConstraints: info.plusBuildConstraints,
-			BinaryOnly:           info.binaryOnly,
-		}
-		if info.parsed != nil {
-			tf.PkgName = info.parsed.Name.Name
-		}
-		data := info.header
-
-		// Going to save the file. For non-Go files, can stop here.
-		p.SourceFiles = append(p.SourceFiles, tf)
-		if ext != ".go" {
-			continue
-		}
+	fset := token.NewFileSet()
+	info, err := getInfo(fsys, fsdir, dir, name, fset)
+	if err != nil {
+		return &TaggedFile{Name: name, Error: err.Error()}
+	} else if info == nil {
+		return &TaggedFile{Name: name, IgnoreFile: true}
+	}
+	tf := &TaggedFile{
+		Name:                 name,
+		GoBuildConstraint:    info.goBuildConstraint,
+		PlusBuildConstraints: info.plusBuildConstraints,
+		BinaryOnly:           info.binaryOnly,
+	}
+	if info.parsed != nil {
+		tf.PkgName = info.parsed.Name.Name
+	}
+	data := info.header
 
-		if info.parseErr != nil {
-			tf.ParseError = info.parseErr.Error()
-			// Fall through: we might still have a partial AST in info.parsed,
-			// and we want to list files with parse errors anyway.
-		}
+	// Going to save the file. For non-Go files, can stop here.
+	if ext != ".go" {
+		return tf
+	}
 
-		if info.parsed != nil && info.parsed.Doc != nil {
-			tf.Synopsis = doc.Synopsis(info.parsed.Doc.Text())
-		}
+	if info.parseErr != nil {
+		tf.ParseError = info.parseErr.Error()
+		// Fall through: we might still have a partial AST in info.parsed,
+		// and we want to list files with parse errors anyway.
+	}
 
-		qcom, line := findImportComment(data)
-		if line != 0 {
-			tf.QuotedImportComment = qcom
-			tf.QuotedImportCommentLine = line
-		}
+	if info.parsed != nil && info.parsed.Doc != nil {
+		tf.Synopsis = doc.Synopsis(info.parsed.Doc.Text())
+	}
 
-		for _, imp := range info.imports {
-			// TODO(matloob): only save doc for cgo?
-			// TODO(matloob): remove filename from position and add it back later to save space?
-			tf.Imports = append(tf.Imports, TFImport{Path: imp.path, Doc: imp.doc.Text(), Position: fset.Position(imp.pos)})
-		}
-		tf.Embeds = make(map[string][]token.Position)
-		for _, emb := range info.embeds {
-			tf.Embeds[emb.pattern] = append(tf.Embeds[emb.pattern], emb.pos)
-		}
+	qcom, line := findImportComment(data)
+	if line != 0 {
+		tf.QuotedImportComment = qcom
+		tf.QuotedImportCommentLine = line
+	}
 
+	for _, imp := range info.imports {
+		// TODO(matloob): only save doc for cgo?
+		tf.Imports = append(tf.Imports, TFImport{Path: imp.path, Doc: imp.doc.Text(), Position: fset.Position(imp.pos)})
 	}
-	return p
+	tf.Embeds = make(map[string][]token.Position)
+	for _, emb := range info.embeds {
+		tf.Embeds[emb.pattern] = append(tf.Embeds[emb.pattern], emb.pos)
+	}
+	return tf
 }
 
-func isDir(path string) bool {
-	fi, err := os.Stat(path)
+func isDir(fsys fs.FS, name string) bool {
+	fi, err := fs.Stat(fsys, name)
 	return err == nil && fi.IsDir()
 }
 
@@ -229,7 +526,10 @@ type fileInfoPlus struct {
 //
 // If allTags is non-nil, matchFile records any encountered build tag
 // by setting allTags[tag] = true.
-func getInfo(dir, name string, fset *token.FileSet) (*fileInfoPlus, error) {
+//
+// The file is read from the directory fsdir within fsys, but is named
+// as a file in dir.
+func getInfo(fsys fs.FS, fsdir, dir, name string, fset *token.FileSet) (*fileInfoPlus, error) {
 	if strings.HasPrefix(name, "_") ||
 		strings.HasPrefix(name, ".") {
 		return nil, nil
@@ -252,9 +552,9 @@ func getInfo(dir, name string, fset *token.FileSet) (*fileInfoPlus, error) {
 		return info, nil
 	}
 
-	f, err := os.Open(info.name)
+	f, err := fsys.Open(path.Join(fsdir, name))
 	if err != nil {
-		return nil, err
+		return nil, osPathError(err, info.name)
 	}
 
 	// TODO(matloob) should we decide whether to ignore binary only here or in
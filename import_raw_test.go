@@ -0,0 +1,247 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"testing/fstest"
+)
+
+// writeLargeModule writes a synthetic module to dir with the given number
+// of packages, each with the given number of files.
+func writeLargeModule(t testing.TB, dir string, packages, files int) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/large\n\ngo 1.18\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < packages; i++ {
+		name := "p" + strconv.Itoa(i)
+		pkgdir := filepath.Join(dir, fmt.Sprintf("d%d", i%10), name)
+		if err := os.MkdirAll(pkgdir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < files; j++ {
+			src := fmt.Sprintf(`//go:build !windows || tag%d
+
+// Package %s is generated.
+package %s
+
+import (
+	"fmt"
+	"strings"
+)
+
+func F%d() string { return fmt.Sprint(strings.ToUpper("x")) }
+`, j, name, name, j)
+			if err := os.WriteFile(filepath.Join(pkgdir, fmt.Sprintf("f%d.go", j)), []byte(src), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestIndexWorkers(t *testing.T) {
+	small := t.TempDir()
+	writeTestModule(t, small)
+	large := t.TempDir()
+	writeLargeModule(t, large, 50, 3)
+
+	for _, moddir := range []string{small, large} {
+		var wantModule *RawModule
+		var wantData []byte
+		for _, workers := range []int{1, 2, 8, 0} {
+			opts := IndexOptions{Workers: workers, IncludeVendor: true, IncludeTestdata: true}
+			rm, err := IndexModuleWithOptions(moddir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := EncodeRawModule(rm, moddir, EncodeOptions{Version: CurrentVersion})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantModule == nil {
+				wantModule, wantData = rm, data
+				continue
+			}
+			if !reflect.DeepEqual(rm, wantModule) {
+				t.Errorf("%s: Workers: %d: RawModule differs from Workers: 1", moddir, workers)
+			}
+			if !bytes.Equal(data, wantData) {
+				t.Errorf("%s: Workers: %d: encoded index differs from Workers: 1", moddir, workers)
+			}
+		}
+	}
+}
+
+// BenchmarkIndexModule measures indexing a synthetic module of 500
+// packages with different numbers of workers.
+func BenchmarkIndexModule(b *testing.B) {
+	moddir := b.TempDir()
+	writeLargeModule(b, moddir, 500, 5)
+	for _, workers := range []int{1, 4, 0} {
+		name := "Workers=" + strconv.Itoa(workers)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := IndexModuleWithOptions(moddir, IndexOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestIndexModuleBadGoMod checks that a module whose go.mod file can't be
+// parsed is still indexed, with its module path but no go.mod contents.
+func TestIndexModuleBadGoMod(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	gomod := "module example.com/m\n\nrequire (\n\tgolang.org/x/mod v0.5.1\n"
+	if err := os.WriteFile(filepath.Join(moddir, "go.mod"), []byte(gomod), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm.Path != "example.com/m" {
+		t.Errorf("Path = %q, want %q", rm.Path, "example.com/m")
+	}
+	if rm.GoMod != nil {
+		t.Errorf("GoMod = %+v, want nil", rm.GoMod)
+	}
+	if len(rm.Dirs) != len(testPackageDirs) {
+		t.Errorf("indexed %d directories, want %d", len(rm.Dirs), len(testPackageDirs))
+	}
+
+	data, err := EncodeRawModule(rm, moddir, EncodeOptions{Version: CurrentVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := openTestIndex(t, data, moddir)
+	if got := mi.ModulePath(); got != "example.com/m" {
+		t.Errorf("ModulePath() = %q, want %q", got, "example.com/m")
+	}
+	if got := mi.GoMod(); got != nil {
+		t.Errorf("GoMod() = %+v, want nil", got)
+	}
+}
+
+// TestIndexOptionsPrune checks which directories of testModule are indexed
+// by default and with each of the Include options.
+func TestIndexOptionsPrune(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+
+	tests := []struct {
+		opts IndexOptions
+		want []string // keys of Dirs, sorted; the module root is ""
+	}{
+		{IndexOptions{}, []string{"", "a", "b", "c", "d"}},
+		{IndexOptions{IncludeVendor: true}, []string{"", "a", "b", "c", "d", "vendor", "vendor/x"}},
+		{IndexOptions{IncludeTestdata: true}, []string{"", "a", "b", "b/testdata", "c", "d"}},
+		{IndexOptions{IncludeIgnored: true}, []string{"", "_skip", "a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		rm, err := IndexModuleWithOptions(moddir, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for dir := range rm.Dirs {
+			got = append(got, dir)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("IndexModuleWithOptions(%+v) indexed %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestImportRawNonLocal(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	goroot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(goroot, "src", "strings"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(goroot, "src", "strings", "strings.go"), []byte("package strings\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without options, non-local and invalid paths are errors.
+	for _, path := range []string{"fmt", "a//b", "example.com/m/a"} {
+		if p := ImportRaw(path, moddir); p.Error == "" {
+			t.Errorf("ImportRaw(%q) = %+v, want Error set", path, p)
+		}
+	}
+
+	opts := ImportRawOptions{ModuleRoot: moddir, ModulePath: "example.com/m", GOROOT: goroot}
+	tests := []struct {
+		path string
+		dir  string // resolved directory, or "" if path doesn't resolve
+	}{
+		{"example.com/m/a", filepath.Join(moddir, "a")},
+		{"example.com/m", moddir},
+		{"strings", filepath.Join(goroot, "src", "strings")},
+		{"example.org/x", ""},
+		{"example.com/mx", ""},
+		{"a//b", ""},
+	}
+	for _, tt := range tests {
+		p := ImportRawWithOptions(tt.path, moddir, opts)
+		if tt.dir == "" {
+			if p.Error == "" {
+				t.Errorf("ImportRawWithOptions(%q) = Dir %s, want Error set", tt.path, p.Dir)
+			}
+			continue
+		}
+		if p.Error != "" || p.Dir != tt.dir {
+			t.Errorf("ImportRawWithOptions(%q) = Dir %s, Error %q; want Dir %s", tt.path, p.Dir, p.Error, tt.dir)
+		}
+	}
+	if p := ImportRawWithOptions("strings", moddir, opts); len(p.SourceFiles) != 1 {
+		t.Errorf("ImportRawWithOptions(strings) read %d files, want 1", len(p.SourceFiles))
+	}
+}
+
+// TestIndexFS checks that indexing a module in an fs.FS produces the same
+// index as indexing the same files on disk.
+func TestIndexFS(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for name, data := range testModule {
+		fsys["mod/"+name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	moddir := filepath.Join(t.TempDir(), "mod")
+	writeTestModule(t, moddir)
+
+	fromFS, err := IndexFS(fsys, "mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDisk, err := IndexModule(moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range testEncodeOptions {
+		got, err := EncodeRawModule(fromFS, "mod", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := EncodeRawModule(fromDisk, moddir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: index of fs.FS differs from index of module on disk", encodingName(opts))
+		}
+	}
+}
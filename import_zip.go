@@ -0,0 +1,52 @@
+package index
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"golang.org/x/mod/module"
+)
+
+// IndexModuleZip indexes the module m from the module zip file at
+// zipfile, in the format described by golang.org/x/mod/zip, without
+// extracting it. The packages are reported as if the module had been
+// extracted to dir: the result is the same as that of IndexModule(dir)
+// on the extracted module, except that its Version is m.Version.
+func IndexModuleZip(zipfile string, m module.Version, dir string) (*RawModule, error) {
+	zr, err := zip.OpenReader(zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return indexZip(&zr.Reader, m, dir)
+}
+
+// IndexModuleZipReader is like IndexModuleZip, but reads the module zip
+// file from r, which has the given size.
+func IndexModuleZipReader(r io.ReaderAt, size int64, m module.Version, dir string) (*RawModule, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return indexZip(zr, m, dir)
+}
+
+func indexZip(zr *zip.Reader, m module.Version, dir string) (*RawModule, error) {
+	// All files in a module zip are within the directory "path@version".
+	prefix := m.Path + "@" + m.Version
+	if fi, err := fs.Stat(zr, prefix); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("module zip for %s has no %s directory", m, prefix)
+	}
+	fsys, err := fs.Sub(zr, prefix)
+	if err != nil {
+		return nil, err
+	}
+	rm, err := indexFS(fsys, ".", dir, IndexOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rm.Version = m.Version
+	return rm, nil
+}
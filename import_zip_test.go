@@ -0,0 +1,90 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+// writeTestModuleZip writes the files of testModule to a module zip file
+// for m, under the directory path@version as in a real module zip.
+func writeTestModuleZip(t testing.TB, zipfile string, m module.Version) {
+	t.Helper()
+	var names []string
+	for name := range testModule {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(m.Path + "@" + m.Version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(testModule[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zipfile, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIndexModuleZip checks that indexing a module zip file produces the
+// same index as indexing the module after extracting it, apart from the
+// module version, which only the zip file records.
+func TestIndexModuleZip(t *testing.T) {
+	m := module.Version{Path: "example.com/m", Version: "v1.0.0"}
+	zipfile := filepath.Join(t.TempDir(), "v1.0.0.zip")
+	writeTestModuleZip(t, zipfile, m)
+	dir := filepath.Join(t.TempDir(), "example.com", "m@v1.0.0")
+	writeTestModule(t, dir)
+
+	extracted, err := IndexModule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped, err := IndexModuleZip(zipfile, m, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipdata, err := os.ReadFile(zipfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zippedReader, err := IndexModuleZipReader(bytes.NewReader(zipdata), int64(len(zipdata)), m, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range testEncodeOptions {
+		want, err := EncodeRawModule(extracted, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rm := range []*RawModule{zipped, zippedReader} {
+			if rm.Version != m.Version {
+				t.Errorf("Version = %q, want %q", rm.Version, m.Version)
+			}
+			withoutVersion := *rm
+			withoutVersion.Version = ""
+			got, err := EncodeRawModule(&withoutVersion, dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: index of module zip differs from index of extracted module", encodingName(opts))
+			}
+		}
+	}
+}
@@ -2,16 +2,38 @@ package index
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"go/build/constraint"
 	"go/token"
 	"io"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
 )
 
+// ModuleIndex is an opened module index. The contents of the index file
+// are held in memory, either mapped directly from the file or read in
+// their entirety if the file can't be mapped or OpenOptions.NoMmap is set.
+//
+// A ModuleIndex is safe for concurrent use by multiple goroutines:
+// all reads are done at absolute offsets into the immutable index data.
 type ModuleIndex struct {
-	f        *os.File
+	data     []byte
+	mapped   bool // data is mapped from the index file and must be unmapped on Close
+	version  int  // format version of the index
+	compact  bool // values are varint-encoded; see EncodeOptions.Compact
+	metadata map[string]string
+	gomod    *GoModInfo // parsed from metadata; nil if the index has no go.mod
+	nested   []string   // module-relative roots of nested modules
 	moddir   string
 	st       *stringTable
 	packages map[string]pkgInfo
@@ -23,79 +45,384 @@ type pkgInfo struct {
 	rawPkgData *RawPackage2
 }
 
-func Open(path string, futurepath string) (mi *ModuleIndex, err error) {
+// OpenOptions controls how an index file is opened.
+type OpenOptions struct {
+	// SkipVerify skips checking the index contents against the
+	// checksum in its header. The length of the index is still checked.
+	SkipVerify bool
+
+	// NoMmap reads the index into memory instead of mapping it. A mapped
+	// index must not be truncated or rewritten in place while it is open:
+	// reading it may then crash the process with a SIGBUS signal, which
+	// can't be recovered from.
+	NoMmap bool
+}
+
+// Open opens the module index at path, verifying its checksum.
+// futurepath is the path the index will be used at, next to
+// the module's go.mod file.
+func Open(path string, futurepath string) (*ModuleIndex, error) {
+	return OpenWithOptions(path, futurepath, OpenOptions{})
+}
+
+// OpenWithOptions is like Open but allows the caller to control
+// how the index is opened.
+func OpenWithOptions(path string, futurepath string, opts OpenOptions) (mi *ModuleIndex, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	moddir := filepath.Dir(futurepath)
-
-	mi = &ModuleIndex{f: f, moddir: moddir}
-
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("error reading module index: %v", e)
+	var data []byte
+	mapped := false
+	if !opts.NoMmap {
+		data, err = mmapFile(f)
+		mapped = err == nil
+	}
+	if !mapped {
+		// Fall back to reading the whole file into memory.
+		if data, err = io.ReadAll(f); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
-	// TODO(matloob): clean this up
-	const indexv0 = "go index v0\n"
-	var indexVersion [len(indexv0)]byte
-	if _, err := io.ReadAtLeast(f, indexVersion[:], len(indexv0)); err != nil {
+	moddir := filepath.Clean(filepath.Dir(futurepath))
+
+	mi = &ModuleIndex{data: data, mapped: mapped, moddir: moddir}
+	if err := mi.readHeader(!opts.SkipVerify); err != nil {
+		mi.Close()
 		return nil, err
-	} else if string(indexVersion[:]) != indexv0 {
-		return nil, fmt.Errorf("bad index version string: %q", string(indexVersion[:]))
 	}
-	stringTableOffset := mi.uint32()
-	stbytes, err := mi.readStringTableBytes(stringTableOffset)
+	return mi, nil
+}
+
+// Verify checks that the index file at path is complete and that its
+// contents match the checksum in its header. Indexes older than Version1
+// carry no checksum, so only their version string is checked.
+func Verify(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	_, err = verify(data, true)
+	return err
+}
+
+// An IndexTooNewError reports that an index was written in a format
+// version newer than this package can read.
+type IndexTooNewError struct {
+	Version int // version of the index
+}
+
+func (e *IndexTooNewError) Error() string {
+	return fmt.Sprintf("module index version %d is newer than supported version %d", e.Version, CurrentVersion)
+}
+
+// parseHeader parses the magic string at the start of the index
+// to determine its format version.
+func parseHeader(data []byte) (indexHeader, error) {
+	const maxMagicLen = len(indexMagicPrefix) + 10 + 1 // prefix, version, newline
+	n := maxMagicLen
+	if len(data) < n {
+		n = len(data)
+	}
+	magic := data[:n]
+	if i := bytes.IndexByte(magic, '\n'); i >= 0 {
+		magic = magic[:i+1]
+	}
+	if !bytes.HasPrefix(magic, []byte(indexMagicPrefix)) || magic[len(magic)-1] != '\n' {
+		return indexHeader{}, fmt.Errorf("bad index version string: %q", string(magic))
+	}
+	version, err := strconv.Atoi(string(magic[len(indexMagicPrefix) : len(magic)-1]))
+	if err != nil || version < 0 || newIndexHeader(version).magic != string(magic) {
+		return indexHeader{}, fmt.Errorf("bad index version string: %q", string(magic))
+	}
+	if version > CurrentVersion {
+		return indexHeader{}, &IndexTooNewError{Version: version}
 	}
-	mi.st = newStringTable(stbytes)
-	numPackages := int(mi.uint32())
+	return newIndexHeader(version), nil
+}
+
+// verify parses and checks the header of the index in data. If checkHash
+// is set, it also checks the contents of the index against the header's
+// checksum. Indexes older than Version1 have no checksum to check.
+func verify(data []byte, checkHash bool) (indexHeader, error) {
+	h, err := parseHeader(data)
+	if err != nil || !h.hasChecksum() {
+		return h, err
+	}
+	if len(data) < h.size() {
+		return h, &CorruptIndexError{Offset: uint32(len(data)), Reason: "index header is truncated"}
+	}
+	if n := binary.LittleEndian.Uint32(data[h.lengthPos():]); uint64(n) != uint64(len(data)) {
+		return h, &CorruptIndexError{Offset: uint32(h.lengthPos()), Reason: fmt.Sprintf("index length %d does not match file size %d", n, len(data))}
+	}
+	if checkHash {
+		sum := sha256.Sum256(data[h.size():])
+		if !bytes.Equal(sum[:], data[h.hashPos():h.size()]) {
+			return h, &CorruptIndexError{Offset: uint32(h.hashPos()), Reason: "checksum mismatch"}
+		}
+	}
+	return h, nil
+}
+
+// readHeader verifies the index and decodes its string table and package list.
+func (mi *ModuleIndex) readHeader(checkHash bool) error {
+	h, err := verify(mi.data, checkHash)
+	if err != nil {
+		return err
+	}
+	mi.version = h.version
+	d := decoderAt{pos: uint32(h.size()), mi: mi}
+	if h.hasFlags() {
+		flags := d.uint32()
+		if d.err != nil {
+			return d.err
+		}
+		if flags&^indexFlagsMask != 0 {
+			return &CorruptIndexError{Offset: uint32(h.size()), Reason: fmt.Sprintf("unknown index flags %#x", flags)}
+		}
+		mi.compact = flags&indexFlagCompact != 0
+	}
+	stringTableOffsetPos := d.pos
+	stringTableOffset := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+	if uint64(stringTableOffset) > uint64(len(mi.data)) {
+		return &CorruptIndexError{Offset: stringTableOffsetPos, Reason: fmt.Sprintf("string table offset %d past end of index", stringTableOffset)}
+	}
+	mi.st = newStringTable(mi.data[stringTableOffset:], stringTableOffset)
+	if h.hasMetadata() {
+		metadataPos := d.pos
+		n := d.count(2) // a key and a value string per entry
+		mi.metadata = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			key := d.string()
+			mi.metadata[key] = d.string()
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if err := mi.readGoMod(); err != nil {
+			return &CorruptIndexError{Offset: metadataPos, Reason: err.Error()}
+		}
+		if nested := mi.metadata[metadataNested]; nested != "" {
+			mi.nested = strings.Split(nested, "\n")
+		}
+	}
+	numPackages := d.count(2) // a string and a package offset per package
 
 	pkgInfos := make([]pkgInfo, numPackages)
 
 	for i := 0; i < numPackages; i++ {
-		pkgInfos[i].dir = mi.st.String(mi.uint32())
+		pkgInfos[i].dir = d.string()
 	}
 	for i := 0; i < numPackages; i++ {
-		pkgInfos[i].offset = mi.uint32()
+		pkgInfos[i].offset = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if mi.version < Version4 {
+		// The package list holds the absolute directories the packages
+		// were indexed in. Key packages by the module-relative directory
+		// stored in the package record instead.
+		for i := range pkgInfos {
+			pd := decoderAt{pos: pkgInfos[i].offset, mi: mi}
+			pd.int() // error
+			pd.int() // path
+			pd.int() // srcdir
+			pkgInfos[i].dir = filepath.ToSlash(pd.string())
+			if pd.err != nil {
+				return pd.err
+			}
+		}
 	}
 	mi.packages = make(map[string]pkgInfo)
 	for i := range pkgInfos {
 		mi.packages[pkgInfos[i].dir] = pkgInfos[i]
 	}
+	return nil
+}
 
-	return mi, nil
+// ModulePath returns the module path of the indexed module, or the
+// empty string if the index doesn't record one.
+func (mi *ModuleIndex) ModulePath() string {
+	return mi.metadata[metadataModulePath]
 }
 
-func (mi *ModuleIndex) RawPackage(path string) (*RawPackage2, bool) {
-	pkgData, ok := mi.packages[path]
+// readGoMod sets mi.gomod from the go.mod entries of the module metadata.
+func (mi *ModuleIndex) readGoMod() error {
+	data, ok := mi.metadata[metadataGoMod]
 	if !ok {
-		return nil, false
+		return nil
 	}
+	gomod := &GoModInfo{
+		Data:   []byte(data),
+		Module: mi.metadata[metadataModulePath],
+		Go:     mi.metadata[metadataGoVersion],
+	}
+	for _, line := range strings.SplitAfter(mi.metadata[metadataRequire], "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.HasSuffix(line, "\n") {
+			return fmt.Errorf("malformed requirement %q", line)
+		}
+		gomod.Require = append(gomod.Require, module.Version{Path: f[0], Version: f[1]})
+	}
+	mi.gomod = gomod
+	return nil
+}
+
+// GoMod returns the contents of the indexed module's go.mod file and a
+// summary of it, or nil if the index doesn't record a go.mod file.
+// The caller may modify the result.
+func (mi *ModuleIndex) GoMod() *GoModInfo {
+	if mi.gomod == nil {
+		return nil
+	}
+	gomod := *mi.gomod
+	gomod.Data = append([]byte(nil), gomod.Data...)
+	gomod.Require = append([]module.Version(nil), gomod.Require...)
+	return &gomod
+}
+
+// ModuleVersion returns the version of the indexed module, or the
+// empty string if the index doesn't record one.
+func (mi *ModuleIndex) ModuleVersion() string {
+	return mi.metadata[metadataModuleVersion]
+}
+
+// importPath returns the import path of the package in the given
+// module-relative directory. The module path must be known.
+func (mi *ModuleIndex) importPath(dir string) string {
+	if dir == "." {
+		return mi.ModulePath()
+	}
+	return mi.ModulePath() + "/" + dir
+}
+
+// packageDirs returns the module-relative directories of the packages
+// in the index, sorted.
+func (mi *ModuleIndex) packageDirs() []string {
+	dirs := make([]string, 0, len(mi.packages))
+	for dir := range mi.packages {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// lookup returns the package identified by dir, which is one of:
+//
+//   - a directory relative to the module root, such as "" or "internal/foo"
+//   - an absolute directory within the directory the index was opened against
+//   - the full import path of a package in the module
+func (mi *ModuleIndex) lookup(dir string) (pkgInfo, bool) {
+	for _, rel := range mi.relDirs(dir) {
+		if pkgData, ok := mi.packages[rel]; ok {
+			return pkgData, true
+		}
+	}
+	return pkgInfo{}, false
+}
+
+// relDirs returns the module-relative directories that dir, in any of
+// the forms accepted by lookup, may refer to, in order of preference.
+func (mi *ModuleIndex) relDirs(dir string) []string {
+	if filepath.IsAbs(dir) {
+		dir = filepath.Clean(dir)
+		if dir == mi.moddir {
+			return []string{"."}
+		}
+		if rel, ok := hasSubdir(mi.moddir, dir); ok {
+			return []string{rel}
+		}
+		return nil
+	}
+	rels := []string{path.Clean(filepath.ToSlash(dir))}
+	if modpath := mi.ModulePath(); modpath != "" {
+		if dir == modpath {
+			rels = append(rels, ".")
+		} else if strings.HasPrefix(dir, modpath+"/") {
+			rels = append(rels, path.Clean(dir[len(modpath)+1:]))
+		}
+	}
+	return rels
+}
+
+// nestedModule reports the module-relative root of the nested module
+// containing dir, if dir is in one.
+func (mi *ModuleIndex) nestedModule(dir string) (root string, ok bool) {
+	for _, rel := range mi.relDirs(dir) {
+		for _, root := range mi.nested {
+			if rel == root || strings.HasPrefix(rel, root+"/") {
+				return root, true
+			}
+		}
+	}
+	return "", false
+}
+
+// RawPackage returns the package record for the given directory, which
+// may be given in any of the forms accepted by ImportPackage. ok is false
+// if the index contains no such directory, including if the directory is
+// in a nested module. A non-nil error is returned if the
+// package record could not be decoded.
+//
+// If the index records the module path, the returned package's Path is
+// its import path.
+//
+// The returned package's SrcDir, and the positions in its source
+// files, are relative to the directory the index was opened against
+// rather than the directory the module was indexed in.
+func (mi *ModuleIndex) RawPackage(path string) (rp *RawPackage2, ok bool, err error) {
+	pkgData, ok := mi.lookup(path)
+	if !ok {
+		return nil, false, nil
+	}
+	rp, err = mi.rawPackage(pkgData)
+	return rp, true, err
+}
+
+// rawPackage decodes the package record described by pkgData.
+func (mi *ModuleIndex) rawPackage(pkgData pkgInfo) (*RawPackage2, error) {
 	rp := new(RawPackage2)
-	// TODO(matloob): do we want to lock on the module index?
-	mi.f.Seek(int64(pkgData.offset), 0 /* relative to origin of file */)
-	rp.Error = mi.string()
-	rp.Path = mi.string()
-	rp.SrcDir = mi.string()
-	rp.Dir = mi.string()
-	numSourceFiles := mi.uint32()
+	d := decoderAt{pos: pkgData.offset, mi: mi}
+	rp.Error = d.string()
+	rp.Path = d.string()
+	if mi.version < Version4 {
+		d.int() // srcdir at indexing time; replaced below
+	}
+	rp.Dir = d.string()
+	rp.SrcDir = filepath.Join(mi.moddir, filepath.FromSlash(pkgData.dir))
+	if mi.ModulePath() != "" {
+		rp.Path = mi.importPath(pkgData.dir)
+	}
+	numSourceFiles := d.count(1)
 	rp.SourceFiles = make([]SourceFile, numSourceFiles)
-	for i := uint32(0); i < numSourceFiles; i++ {
+	for i := 0; i < numSourceFiles; i++ {
 		rp.SourceFiles[i].mi = mi
-		rp.SourceFiles[i].offset = mi.uint32()
+		rp.SourceFiles[i].offset = d.uint32()
+		rp.SourceFiles[i].dir = rp.SrcDir
+	}
+	if mi.version >= Version7 {
+		numTags := d.count(1)
+		for i := 0; i < numTags; i++ {
+			rp.allTags = append(rp.allTags, d.string())
+		}
 	}
-	return rp, true
+	if d.err != nil {
+		return nil, d.err
+	}
+	return rp, nil
 }
 
 type RawPackage2 struct {
-	// TODO(matloob): Do we need AllTags in RawPackage?
-	// We can produce it from contstraints when we evaluate them.
-
 	Error string
 
 	// Arguments to build.Import. Is path always "."?
@@ -108,20 +435,26 @@ type RawPackage2 struct {
 	SourceFiles []SourceFile
 
 	// No ConflictDir-- only relevant togopath
+
+	allTags []string // tags mentioned by the source files, from Version7 on
 }
 
+// A SourceFile is a lazily decoded source file record in a module index.
+// It is not modified after it is created, so it can be read from
+// multiple goroutines.
 type SourceFile struct {
 	mi *ModuleIndex // index file. TODO(matloob): make a specific decoder type?
 
-	offset                                uint32
-	savedImportsOffset, savedEmbedsOffset uint32
+	offset uint32
+	dir    string // directory the file is in, for reconstructing positions
 
 	// TODO(matloob): do we want to save the fields? I think no, because we probably don't
 	// need to load the same package twice. We can always add it later.
 }
 
+// Fields of a source file record, in the order they are encoded.
 const (
-	sourceFileErrorOffset = 4 * iota
+	sourceFileError = iota
 	sourceFileParseError
 	sourceFileSynopsis
 	sourceFileName
@@ -134,102 +467,177 @@ const (
 	sourceFileNumPlusBuildConstraints
 )
 
-func (sf *SourceFile) error() string {
-	return sf.mi.stringAt(sf.offset + sourceFileErrorOffset)
+// field returns a decoder positioned at the given field of the source file record.
+func (sf *SourceFile) field(field int) decoderAt {
+	d := decoderAt{pos: sf.offset, mi: sf.mi}
+	if !sf.mi.compact {
+		// Each field up to the build constraints is four bytes long.
+		d.pos += 4 * uint32(field)
+		return d
+	}
+	// Each field up to the build constraints is a single varint,
+	// but IgnoreFile and BinaryOnly share one flags field.
+	switch {
+	case field == sourceFileBinaryOnly:
+		field = sourceFileIgnoreFile
+	case field > sourceFileBinaryOnly:
+		field--
+	}
+	for i := 0; i < field; i++ {
+		d.int()
+	}
+	return d
 }
 
-func (sf *SourceFile) parseError() string {
-	return sf.mi.stringAt(sf.offset + sourceFileParseError)
+func (sf *SourceFile) stringField(field int) (string, error) {
+	d := sf.field(field)
+	s := d.string()
+	return s, d.err
 }
 
-func (sf *SourceFile) name() string {
-	return sf.mi.stringAt(sf.offset + sourceFileName)
+// boolField returns the value of the IgnoreFile or BinaryOnly field.
+func (sf *SourceFile) boolField(field int, flag int) (bool, error) {
+	d := sf.field(field)
+	if sf.mi.compact {
+		return d.int()&flag != 0, d.err
+	}
+	b := d.bool()
+	return b, d.err
 }
 
-func (sf *SourceFile) synopsis() string {
-	return sf.mi.stringAt(sf.offset + sourceFileSynopsis)
+func (sf *SourceFile) error() (string, error) {
+	return sf.stringField(sourceFileError)
 }
 
-func (sf *SourceFile) pkgName() string {
-	return sf.mi.stringAt(sf.offset + sourceFilePkgName)
+func (sf *SourceFile) parseError() (string, error) {
+	return sf.stringField(sourceFileParseError)
 }
 
-func (sf *SourceFile) ignoreFile() bool {
-	return sf.mi.boolAt(sf.offset + sourceFileIgnoreFile)
+func (sf *SourceFile) name() (string, error) {
+	return sf.stringField(sourceFileName)
 }
 
-func (sf *SourceFile) binaryOnly() bool {
-	return sf.mi.boolAt(sf.offset + sourceFileBinaryOnly)
+func (sf *SourceFile) synopsis() (string, error) {
+	return sf.stringField(sourceFileSynopsis)
 }
 
-func (sf *SourceFile) quotedImportComment() string {
-	return sf.mi.stringAt(sf.offset + sourceFileQuotedImportComment)
+func (sf *SourceFile) pkgName() (string, error) {
+	return sf.stringField(sourceFilePkgName)
 }
 
-func (sf *SourceFile) quotedImportCommentLine() int {
-	return int(sf.mi.uint32At(sf.offset + sourceFileQuotedImportCommentLine))
+func (sf *SourceFile) ignoreFile() (bool, error) {
+	return sf.boolField(sourceFileIgnoreFile, sourceFileFlagIgnoreFile)
 }
 
-func (sf *SourceFile) goBuildConstraint() string {
-	return sf.mi.stringAt(sf.offset + sourceFileGoBuildConstraint)
+func (sf *SourceFile) binaryOnly() (bool, error) {
+	return sf.boolField(sourceFileBinaryOnly, sourceFileFlagBinaryOnly)
 }
 
-func (sf *SourceFile) plusBuildConstraints() []string {
+func (sf *SourceFile) quotedImportComment() (string, error) {
+	return sf.stringField(sourceFileQuotedImportComment)
+}
+
+func (sf *SourceFile) quotedImportCommentLine() (int, error) {
+	d := sf.field(sourceFileQuotedImportCommentLine)
+	n := d.int()
+	return n, d.err
+}
+
+func (sf *SourceFile) goBuildConstraint() (string, error) {
+	return sf.stringField(sourceFileGoBuildConstraint)
+}
+
+func (sf *SourceFile) plusBuildConstraints() ([]string, error) {
 	var ret []string
 
-	d := decoderAt{sf.offset + sourceFileNumPlusBuildConstraints, sf.mi}
-	n := int(d.uint32())
+	d := sf.field(sourceFileNumPlusBuildConstraints)
+	n := d.count(1)
 	for i := 0; i < n; i++ {
 		ret = append(ret, d.string())
 	}
-	sf.savedImportsOffset = d.pos
-	return ret
+	return ret, d.err
 }
 
-func (sf *SourceFile) importsOffset() uint32 {
-	if sf.savedImportsOffset != 0 {
-		return sf.savedImportsOffset
+func (sf *SourceFile) importsOffset() (uint32, error) {
+	d := sf.field(sourceFileNumPlusBuildConstraints)
+	numPlusBuildConstraints := d.count(1)
+	for i := 0; i < numPlusBuildConstraints; i++ {
+		d.int()
 	}
-	numPlusBuildConstraints := sf.mi.uint32At(sf.offset + sourceFileNumPlusBuildConstraints)
-	sf.savedImportsOffset = sf.offset + sourceFileNumPlusBuildConstraints + 4*(numPlusBuildConstraints+1) // 4 bytes per uin32, add one to advance past numPlusBuildConstraints itself
-	return sf.savedImportsOffset
+	return d.pos, d.err
 }
 
-func (sf *SourceFile) embedsOffset() uint32 {
-	if sf.savedEmbedsOffset != 0 {
-		return sf.savedEmbedsOffset
+func (sf *SourceFile) embedsOffset() (uint32, error) {
+	importsOffset, err := sf.importsOffset()
+	if err != nil {
+		return 0, err
+	}
+	d := decoderAt{pos: importsOffset, mi: sf.mi}
+	numImports := d.count(5)
+	for i := 0; i < numImports; i++ {
+		d.int() // path
+		d.int() // doc
+		d.tokpos("")
 	}
-	importsOffset := sf.importsOffset()
-	numImports := sf.mi.uint32At(importsOffset)
-	// 4 bytes per uint32; 1 to advance past numImports itself, and 6 uint32s per import
-	sf.savedEmbedsOffset = importsOffset + 4*(1+(6*numImports))
-	return sf.savedEmbedsOffset
+	return d.pos, d.err
 }
 
-func (sf *SourceFile) imports() []TFImport {
+func (sf *SourceFile) imports() ([]TFImport, error) {
 	var ret []TFImport
 
-	importsOffset := sf.importsOffset()
-	d := decoderAt{importsOffset, sf.mi}
-	numImports := int(d.uint32())
+	filename, err := sf.filename()
+	if err != nil {
+		return nil, err
+	}
+	importsOffset, err := sf.importsOffset()
+	if err != nil {
+		return nil, err
+	}
+	d := decoderAt{pos: importsOffset, mi: sf.mi}
+	numImports := d.count(5)
 	for i := 0; i < numImports; i++ {
 		path := d.string()
 		doc := d.string()
-		pos := d.tokpos()
+		pos := d.tokpos(filename)
 		ret = append(ret, TFImport{
 			Path:     path,
 			Doc:      doc, // TODO(matloob): only save for cgo?
 			Position: pos,
 		})
 	}
-	return ret
+	return ret, d.err
 }
 
-func (da *decoderAt) tokpos() token.Position {
-	file := da.string()
-	offset := int(da.uint32())
-	line := int(da.uint32())
-	column := int(da.uint32())
+// filename returns the full path of the source file, as used in
+// the positions of its imports and embeds.
+func (sf *SourceFile) filename() (string, error) {
+	name, err := sf.name()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sf.dir, name), nil
+}
+
+// tokpos reads a position in the file with the given full path.
+// Before Version3, positions store the path the file had when it was
+// indexed; it is ignored so that positions are relative to the directory
+// the index is opened against. In the compact encoding, the offset and
+// line are deltas from the previous position read by the decoder.
+func (da *decoderAt) tokpos(filename string) token.Position {
+	file := filename
+	if da.mi.version < Version3 {
+		da.int()
+	}
+	var offset, line int
+	if da.mi.compact {
+		offset = da.prevOffset + da.varint()
+		line = da.prevLine + da.varint()
+		da.prevOffset, da.prevLine = offset, line
+	} else {
+		offset = da.int()
+		line = da.int()
+	}
+	column := da.int()
 	return token.Position{
 		Filename: file,
 		Offset:   offset,
@@ -238,129 +646,356 @@ func (da *decoderAt) tokpos() token.Position {
 	}
 }
 
-func (sf *SourceFile) embeds() []embed {
+func (sf *SourceFile) constraintsOffset() (uint32, error) {
+	embedsOffset, err := sf.embedsOffset()
+	if err != nil {
+		return 0, err
+	}
+	d := decoderAt{pos: embedsOffset, mi: sf.mi}
+	numEmbeds := d.count(4)
+	for i := 0; i < numEmbeds; i++ {
+		d.int() // pattern
+		d.tokpos("")
+	}
+	return d.pos, d.err
+}
+
+// constraints returns the file's parsed build constraints. Before
+// Version6, they are parsed from the constraint lines in the index.
+func (sf *SourceFile) constraints() (parsedConstraints, error) {
+	if sf.mi.version < Version6 {
+		name, err := sf.name()
+		if err != nil {
+			return parsedConstraints{}, err
+		}
+		goBuild, err := sf.goBuildConstraint()
+		if err != nil {
+			return parsedConstraints{}, err
+		}
+		plusBuild, err := sf.plusBuildConstraints()
+		if err != nil {
+			return parsedConstraints{}, err
+		}
+		return parseConstraints(name, goBuild, plusBuild), nil
+	}
+
+	constraintsOffset, err := sf.constraintsOffset()
+	if err != nil {
+		return parsedConstraints{}, err
+	}
+	d := decoderAt{pos: constraintsOffset, mi: sf.mi}
+	c := d.constraints()
+	if d.err != nil {
+		return parsedConstraints{}, d.err
+	}
+	return c, nil
+}
+
+// mentionedTags returns the build tags the file mentions, regardless
+// of build context. Before Version7, they are computed from the file's
+// name, build constraints and imports.
+func (sf *SourceFile) mentionedTags() ([]string, error) {
+	if sf.mi.version < Version7 {
+		name, err := sf.name()
+		if err != nil {
+			return nil, err
+		}
+		c, err := sf.constraints()
+		if err != nil {
+			return nil, err
+		}
+		imports, err := sf.imports()
+		if err != nil {
+			return nil, err
+		}
+		importsC := false
+		for _, imp := range imports {
+			if imp.Path == "C" {
+				importsC = true
+			}
+		}
+		return mentionedTags(name, &c, importsC), nil
+	}
+
+	constraintsOffset, err := sf.constraintsOffset()
+	if err != nil {
+		return nil, err
+	}
+	d := decoderAt{pos: constraintsOffset, mi: sf.mi}
+	d.constraints()
+	var tags []string
+	numTags := d.count(1)
+	for i := 0; i < numTags; i++ {
+		tags = append(tags, d.string())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return tags, nil
+}
+
+// constraints reads a source file's parsed build constraints.
+func (da *decoderAt) constraints() parsedConstraints {
+	var c parsedConstraints
+	c.err = da.string()
+	c.goBuild = da.expr(0)
+	numPlusBuild := da.count(1)
+	for i := 0; i < numPlusBuild; i++ {
+		at := da.pos
+		x := da.expr(0)
+		if x == nil && da.err == nil {
+			da.err = &CorruptIndexError{Offset: at, Reason: "missing // +build expression"}
+		}
+		c.plusBuild = append(c.plusBuild, x)
+	}
+	numTags := da.count(1)
+	for i := 0; i < numTags; i++ {
+		c.tags = append(c.tags, da.string())
+	}
+	return c
+}
+
+func (sf *SourceFile) embeds() ([]embed, error) {
 	var ret []embed
 
-	embedsOffset := sf.embedsOffset()
-	d := decoderAt{embedsOffset, sf.mi}
-	numEmbeds := int(d.uint32())
+	filename, err := sf.filename()
+	if err != nil {
+		return nil, err
+	}
+	embedsOffset, err := sf.embedsOffset()
+	if err != nil {
+		return nil, err
+	}
+	d := decoderAt{pos: embedsOffset, mi: sf.mi}
+	numEmbeds := d.count(4)
 	for i := 0; i < numEmbeds; i++ {
 		pattern := d.string()
-		pos := d.tokpos()
+		pos := d.tokpos(filename)
 		ret = append(ret, embed{pattern, pos})
 	}
-	return ret
+	return ret, d.err
+}
+
+// A CorruptIndexError reports that the module index is malformed:
+// a value in the index is out of range or refers to data past the end
+// of the index.
+type CorruptIndexError struct {
+	Offset uint32 // offset in the index of the malformed value
+	Reason string
+}
+
+func (e *CorruptIndexError) Error() string {
+	return fmt.Sprintf("corrupt module index at offset %d: %s", e.Offset, e.Reason)
 }
 
+// A decoderAt reads a sequence of values starting at pos.
+// The first error encountered is saved in err, and all reads
+// after an error return zero values.
 type decoderAt struct {
 	pos uint32
 	mi  *ModuleIndex
+	err error
+
+	prevOffset, prevLine int // previous position read, for delta-encoded positions
 }
 
+// uint32 reads a four-byte value. Offsets within the index are always
+// encoded this way, so that they can be filled in after they're written.
 func (da *decoderAt) uint32() uint32 {
-	n := da.mi.uint32At(da.pos)
+	if da.err != nil {
+		return 0
+	}
+	n, err := da.mi.uint32At(da.pos)
+	if err != nil {
+		da.err = err
+		return 0
+	}
 	da.pos += 4
 	return n
 }
 
-func (da *decoderAt) string() string {
-	s := da.mi.stringAt(da.pos)
-	da.pos += 4
-	return s
-}
-
-func (mi *ModuleIndex) uint32() uint32 {
-	var n uint32
-	if err := binary.Read(mi.f, binary.LittleEndian, &n); err != nil {
-		panic(err)
+// int reads an unsigned value: a varint in the compact encoding,
+// and a four-byte value otherwise.
+func (da *decoderAt) int() int {
+	if !da.mi.compact {
+		return int(da.uint32())
 	}
-	return n
+	if da.err != nil {
+		return 0
+	}
+	if uint64(da.pos) >= uint64(len(da.mi.data)) {
+		da.err = &CorruptIndexError{Offset: da.pos, Reason: "unexpected end of index"}
+		return 0
+	}
+	n, size := binary.Uvarint(da.mi.data[da.pos:])
+	if size <= 0 || n > math.MaxUint32 {
+		da.err = &CorruptIndexError{Offset: da.pos, Reason: "invalid varint"}
+		return 0
+	}
+	da.pos += uint32(size)
+	return int(n)
 }
 
-func (mi *ModuleIndex) uint32At(offset uint32) uint32 {
-	b := make([]byte, 4)
-	if _, err := mi.f.ReadAt(b, int64(offset)); err != nil {
-		panic(err)
+// varint reads a signed varint. It is only used by the compact encoding.
+func (da *decoderAt) varint() int {
+	if da.err != nil {
+		return 0
 	}
-	var n uint32
-	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &n); err != nil {
-		panic(err)
+	if uint64(da.pos) >= uint64(len(da.mi.data)) {
+		da.err = &CorruptIndexError{Offset: da.pos, Reason: "unexpected end of index"}
+		return 0
 	}
-	return n
+	n, size := binary.Varint(da.mi.data[da.pos:])
+	if size <= 0 || n < math.MinInt32 || n > math.MaxInt32 {
+		da.err = &CorruptIndexError{Offset: da.pos, Reason: "invalid varint"}
+		return 0
+	}
+	da.pos += uint32(size)
+	return int(n)
 }
 
-func (mi *ModuleIndex) boolAt(offset uint32) bool {
-	switch v := mi.uint32At(offset); v {
+func (da *decoderAt) bool() bool {
+	at := da.pos
+	switch v := da.int(); v {
 	case 0:
 		return false
 	case 1:
 		return true
 	default:
-		panic(fmt.Errorf("invalid bool value for SourceFile.IgnoreFile:", v))
+		if da.err == nil {
+			da.err = &CorruptIndexError{Offset: at, Reason: fmt.Sprintf("invalid bool value %d", v)}
+		}
+		return false
 	}
 }
 
-func (mi *ModuleIndex) Close() error {
-	return mi.f.Close()
+// maxExprDepth is the deepest build constraint expression the decoder
+// reads, protecting it from exhausting the stack on a corrupt index.
+const maxExprDepth = 10000
+
+// expr reads a build constraint expression, which is nil if absent.
+// depth is the depth of the expression within the enclosing expression.
+func (da *decoderAt) expr(depth int) constraint.Expr {
+	at := da.pos
+	if depth > maxExprDepth {
+		if da.err == nil {
+			da.err = &CorruptIndexError{Offset: at, Reason: "build constraint nested too deeply"}
+		}
+		return nil
+	}
+	switch kind := da.int(); kind {
+	case exprNone:
+		return nil
+	case exprTag:
+		return &constraint.TagExpr{Tag: da.string()}
+	case exprNot:
+		return &constraint.NotExpr{X: da.operand(depth)}
+	case exprAnd:
+		return &constraint.AndExpr{X: da.operand(depth), Y: da.operand(depth)}
+	case exprOr:
+		return &constraint.OrExpr{X: da.operand(depth), Y: da.operand(depth)}
+	default:
+		if da.err == nil {
+			da.err = &CorruptIndexError{Offset: at, Reason: fmt.Sprintf("invalid build constraint expression kind %d", kind)}
+		}
+		return nil
+	}
 }
 
-type stringTable struct {
-	b       []byte
-	strings map[uint32]string
+// operand reads an operand of an operator at the given depth, which
+// must be present.
+func (da *decoderAt) operand(depth int) constraint.Expr {
+	at := da.pos
+	x := da.expr(depth + 1)
+	if x == nil && da.err == nil {
+		da.err = &CorruptIndexError{Offset: at, Reason: "missing build constraint operand"}
+	}
+	return x
 }
 
-func (mi *ModuleIndex) string() string {
-	return mi.st.String(mi.uint32())
+func (da *decoderAt) string() string {
+	pos := da.int()
+	if da.err != nil {
+		return ""
+	}
+	s, err := da.mi.st.String(uint32(pos))
+	if err != nil {
+		da.err = err
+		return ""
+	}
+	return s
 }
 
-func (mi *ModuleIndex) stringAt(offset uint32) string {
-	return mi.st.String(mi.uint32At(offset))
+// count reads the length of a list whose elements each consist of at
+// least fields values, checking that the list fits within the index.
+func (da *decoderAt) count(fields int) int {
+	at := da.pos
+	n := da.int()
+	if da.err != nil {
+		return 0
+	}
+	elemSize := uint64(fields)
+	if !da.mi.compact {
+		elemSize *= 4
+	}
+	if uint64(n)*elemSize > uint64(len(da.mi.data))-uint64(da.pos) {
+		da.err = &CorruptIndexError{Offset: at, Reason: fmt.Sprintf("list length %d exceeds size of index", n)}
+		return 0
+	}
+	return n
 }
 
-func (mi *ModuleIndex) readStringTableBytes(pos uint32) ([]byte, error) {
-	st, err := mi.f.Stat()
-	if err != nil {
-		return nil, err
+func (mi *ModuleIndex) uint32At(offset uint32) (uint32, error) {
+	if uint64(offset)+4 > uint64(len(mi.data)) {
+		return 0, &CorruptIndexError{Offset: offset, Reason: "unexpected end of index"}
 	}
-	size := st.Size()
-	stlen := int(size) - int(pos)
-	buf := make([]byte, stlen)
-	n, err := mi.f.ReadAt(buf, int64(pos))
-	if err != nil && err != io.EOF {
-		return nil, err
-	} else if n != stlen {
-		return nil, fmt.Errorf("did not read whole string table TODO should i keep reading?", n, stlen)
+	return binary.LittleEndian.Uint32(mi.data[offset:]), nil
+}
+
+// Close releases the memory held by the module index. The ModuleIndex and
+// any SourceFiles obtained from it must not be used after Close.
+func (mi *ModuleIndex) Close() error {
+	data, mapped := mi.data, mi.mapped
+	mi.data, mi.mapped = nil, false
+	if mapped {
+		return munmap(data)
 	}
-	return buf, nil
+	return nil
+}
+
+// A stringTable decodes strings from the string table section of the index.
+// Decoded strings are interned so that repeated lookups don't allocate.
+// It is safe for concurrent use.
+type stringTable struct {
+	b       []byte
+	offset  uint32   // offset of the string table in the index
+	strings sync.Map // map[uint32]string
 }
 
 // TODO(matloob): is it ok to read the entire string table? Should we read strings directly
 // from the file?
 
-func newStringTable(b []byte) *stringTable {
-	return &stringTable{b: b, strings: make(map[uint32]string)}
+func newStringTable(b []byte, offset uint32) *stringTable {
+	return &stringTable{b: b, offset: offset}
 }
 
-func (st *stringTable) String(pos uint32) string {
+func (st *stringTable) String(pos uint32) (string, error) {
 	if pos == 0 {
-		return ""
+		return "", nil
 	}
-	if s, ok := st.strings[pos]; ok {
-		return s
+	if s, ok := st.strings.Load(pos); ok {
+		return s.(string), nil
 	}
-	var b bytes.Buffer
-	i := int(pos)
-	for ; i < len(st.b); i++ {
-		c := st.b[i]
-		if c == 0 {
-			break
-		}
-		b.WriteByte(c)
+	if uint64(pos) >= uint64(len(st.b)) {
+		return "", &CorruptIndexError{Offset: st.offset + pos, Reason: "string offset past end of string table"}
 	}
-	if i == len(st.b) {
-		panic("reached end of string table trying to read string")
+	i := bytes.IndexByte(st.b[pos:], 0)
+	if i < 0 {
+		return "", &CorruptIndexError{Offset: st.offset + pos, Reason: "reached end of string table trying to read string"}
 	}
-	s := b.String()
-	st.strings[pos] = s
-	return s
+	s := string(st.b[pos : pos+uint32(i)])
+	// Another goroutine may have decoded the same string concurrently;
+	// use whichever copy was stored first.
+	actual, _ := st.strings.LoadOrStore(pos, s)
+	return actual.(string), nil
 }
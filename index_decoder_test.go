@@ -0,0 +1,641 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+// allEncodeOptions returns the options for every supported encoding.
+func allEncodeOptions() []EncodeOptions {
+	var all []EncodeOptions
+	for v := Version0; v <= CurrentVersion; v++ {
+		all = append(all, EncodeOptions{Version: v})
+		if v >= Version2 {
+			all = append(all, EncodeOptions{Version: v, Compact: true})
+		}
+	}
+	return all
+}
+
+// encodingName names the encoding selected by opts in test output.
+func encodingName(opts EncodeOptions) string {
+	if opts.Compact {
+		return fmt.Sprintf("v%d-compact", opts.Version)
+	}
+	return fmt.Sprintf("v%d", opts.Version)
+}
+
+// readRawFileFields is like readRawFile, but decodes each field
+// separately through the SourceFile accessors.
+func readRawFileFields(sf *SourceFile) (*rawFile, error) {
+	var f rawFile
+	var err error
+	if f.name, err = sf.name(); err != nil {
+		return nil, err
+	}
+	if f.error, err = sf.error(); err != nil {
+		return nil, err
+	}
+	if f.parseError, err = sf.parseError(); err != nil {
+		return nil, err
+	}
+	if f.synopsis, err = sf.synopsis(); err != nil {
+		return nil, err
+	}
+	if f.pkgName, err = sf.pkgName(); err != nil {
+		return nil, err
+	}
+	if f.ignoreFile, err = sf.ignoreFile(); err != nil {
+		return nil, err
+	}
+	if f.binaryOnly, err = sf.binaryOnly(); err != nil {
+		return nil, err
+	}
+	if f.quotedImportComment, err = sf.quotedImportComment(); err != nil {
+		return nil, err
+	}
+	if f.quotedImportCommentLine, err = sf.quotedImportCommentLine(); err != nil {
+		return nil, err
+	}
+	if f.constraints, err = sf.constraints(); err != nil {
+		return nil, err
+	}
+	if f.imports, err = sf.imports(); err != nil {
+		return nil, err
+	}
+	if f.embeds, err = sf.embeds(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func TestReadRawFile(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	for _, opts := range allEncodeOptions() {
+		mi := openTestIndex(t, encodeTestIndex(t, moddir, opts), moddir)
+		for _, dir := range testPackageDirs {
+			rp, _, err := mi.RawPackage(dir)
+			if err != nil {
+				t.Fatalf("%s: %v", encodingName(opts), err)
+			}
+			for i := range rp.SourceFiles {
+				sf := &rp.SourceFiles[i]
+				got, err := readRawFile(sf)
+				if err != nil {
+					t.Fatalf("%s: %s: %v", encodingName(opts), dir, err)
+				}
+				want, err := readRawFileFields(sf)
+				if err != nil {
+					t.Fatalf("%s: %s: %v", encodingName(opts), dir, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: %s: readRawFile = %+v, want %+v", encodingName(opts), filepath.Join(dir, want.name), got, want)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkImportPackage compares the cost of reading packages from the
+// fixed-width and compact encodings of this module's index.
+func BenchmarkImportPackage(b *testing.B) {
+	moddir, err := filepath.Abs(".")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, opts := range testEncodeOptions {
+		b.Run(encodingName(opts), func(b *testing.B) {
+			data, err := EncodeRawModule(rm, moddir, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			mi := openTestIndex(b, data, moddir)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for dir := range rm.Dirs {
+					mi.ImportPackage(build.Default, filepath.Join(moddir, dir), 0)
+				}
+			}
+		})
+	}
+}
+
+// TestRelocate checks that an index can be used after the module it was
+// made from is moved: everything ImportPackage reports must be relative
+// to the directory the index is opened against.
+func TestRelocate(t *testing.T) {
+	linux := build.Default
+	linux.GOOS, linux.GOARCH, linux.CgoEnabled = "linux", "amd64", true
+
+	for _, opts := range allEncodeOptions() {
+		src := filepath.Join(t.TempDir(), "src")
+		dst := filepath.Join(t.TempDir(), "dst")
+		writeTestModule(t, src)
+		data := encodeTestIndex(t, src, opts)
+		if err := os.Rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		mi := openTestIndex(t, data, dst)
+
+		for _, dir := range testPackageDirs {
+			p, _ := mi.ImportPackage(linux, filepath.Join(dst, dir), 0)
+			if want := filepath.Join(dst, dir); p.Dir != want {
+				t.Errorf("%s: %s: Dir = %s, want %s", encodingName(opts), dir, p.Dir, want)
+			}
+			js, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(js, []byte(src)) {
+				t.Errorf("%s: %s: package refers to original directory %s:\n%s", encodingName(opts), dir, src, js)
+			}
+		}
+
+		a, err := mi.ImportPackage(linux, filepath.Join(dst, "a"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aGo := filepath.Join(dst, "a", "a.go")
+		if pos := a.ImportPos["fmt"]; len(pos) != 1 || pos[0].Filename != aGo {
+			t.Errorf("%s: ImportPos[fmt] = %v, want position in %s", encodingName(opts), pos, aGo)
+		}
+		if pos := a.EmbedPatternPos["b.txt"]; len(pos) != 1 || pos[0].Filename != aGo {
+			t.Errorf("%s: EmbedPatternPos[b.txt] = %v, want position in %s", encodingName(opts), pos, aGo)
+		}
+
+		b, err := mi.ImportPackage(linux, filepath.Join(dst, "b"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ${SRCDIR} is expanded, and relative paths made absolute, in
+		// the directory the index is opened against.
+		bdir := filepath.Join(dst, "b")
+		wantCFLAGS := []string{"-I" + bdir + "/inc", "-I" + filepath.Join(bdir, "inc2")}
+		if !reflect.DeepEqual(b.CgoCFLAGS, wantCFLAGS) {
+			t.Errorf("%s: CgoCFLAGS = %q, want %q", encodingName(opts), b.CgoCFLAGS, wantCFLAGS)
+		}
+		wantLDFLAGS := []string{"-L", filepath.Join(bdir, "lib")}
+		if !reflect.DeepEqual(b.CgoLDFLAGS, wantLDFLAGS) {
+			t.Errorf("%s: CgoLDFLAGS = %q, want %q", encodingName(opts), b.CgoLDFLAGS, wantLDFLAGS)
+		}
+	}
+}
+
+// TestLookupForms checks that every form of directory accepted by
+// ImportPackage finds the same package, and that a directory outside
+// the module finds none.
+func TestLookupForms(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+
+	tests := []struct {
+		dir  string
+		want string // module-relative directory of the package found
+	}{
+		{"", "."},
+		{".", "."},
+		{"example.com/m", "."},
+		{moddir, "."},
+		{"a", "a"},
+		{"./a", "a"},
+		{"example.com/m/a", "a"},
+		{filepath.Join(moddir, "a"), "a"},
+	}
+	for _, tt := range tests {
+		rp, ok, err := mi.RawPackage(tt.dir)
+		if err != nil || !ok {
+			t.Errorf("RawPackage(%q) = _, %v, %v; want package %s", tt.dir, ok, err, tt.want)
+			continue
+		}
+		if want := filepath.Join(moddir, tt.want); rp.SrcDir != want {
+			t.Errorf("RawPackage(%q).SrcDir = %s, want %s", tt.dir, rp.SrcDir, want)
+		}
+		p, _ := mi.ImportPackage(build.Default, tt.dir, 0)
+		if want := filepath.Join(moddir, tt.want); p.Dir != want {
+			t.Errorf("ImportPackage(%q).Dir = %s, want %s", tt.dir, p.Dir, want)
+		}
+	}
+
+	for _, dir := range []string{
+		filepath.Join(t.TempDir(), "a"),
+		moddir + "x",
+		filepath.Join(moddir+"x", "a"),
+	} {
+		if _, ok, err := mi.RawPackage(dir); ok || err != nil {
+			t.Errorf("RawPackage(%q) = _, %v, %v; want not found", dir, ok, err)
+		}
+		if _, err := mi.ImportPackage(build.Default, dir, 0); err == nil {
+			t.Errorf("ImportPackage(%q) succeeded for a directory outside the module", dir)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	for v := Version0; v <= CurrentVersion; v++ {
+		magic := fmt.Sprintf("go index v%d\n", v)
+		h, err := parseHeader([]byte(magic + "body"))
+		if err != nil || h.version != v {
+			t.Errorf("parseHeader(%q) = version %d, %v; want version %d", magic, h.version, err, v)
+		}
+	}
+
+	var tooNew *IndexTooNewError
+	if _, err := parseHeader([]byte("go index v99\n")); !errors.As(err, &tooNew) || tooNew.Version != 99 {
+		t.Errorf("parseHeader(v99): got error %v, want *IndexTooNewError with Version 99", err)
+	}
+	for _, bad := range []string{
+		"go index v01\n",
+		"go index v-1\n",
+		"go index v1",
+		"go index v\n",
+		"go index x1\n",
+		"",
+	} {
+		if _, err := parseHeader([]byte(bad)); err == nil || errors.As(err, &tooNew) {
+			t.Errorf("parseHeader(%q): got error %v, want bad version string", bad, err)
+		}
+	}
+}
+
+func TestGoMod(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+
+	gomod := mi.GoMod()
+	if gomod == nil {
+		t.Fatal("GoMod() = nil")
+	}
+	if string(gomod.Data) != testModule["go.mod"] {
+		t.Errorf("GoMod().Data = %q, want %q", gomod.Data, testModule["go.mod"])
+	}
+	if gomod.Module != "example.com/m" || gomod.Go != "1.18" {
+		t.Errorf("GoMod() Module, Go = %q, %q; want %q, %q", gomod.Module, gomod.Go, "example.com/m", "1.18")
+	}
+	wantRequire := []module.Version{{Path: "golang.org/x/mod", Version: "v0.5.1"}}
+	if !reflect.DeepEqual(gomod.Require, wantRequire) {
+		t.Errorf("GoMod().Require = %v, want %v", gomod.Require, wantRequire)
+	}
+
+	// The result belongs to the caller.
+	gomod.Data[0] = 'x'
+	gomod.Module = "x"
+	gomod.Require[0].Version = "v0.0.0"
+	if again := mi.GoMod(); string(again.Data) != testModule["go.mod"] || again.Module != "example.com/m" || !reflect.DeepEqual(again.Require, wantRequire) {
+		t.Errorf("GoMod() after modifying an earlier result = %+v", again)
+	}
+}
+
+// TestChecksum checks that a change to the body of an index is caught
+// by Open and Verify, unless verification is skipped.
+func TestChecksum(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	data := encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion})
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.index")
+	if err := os.WriteFile(good, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.index")
+	data = append([]byte(nil), data...)
+	data[len(data)-1] ^= 1 // without updating the checksum
+	if err := os.WriteFile(bad, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var cerr *CorruptIndexError
+	if _, err := Open(bad, bad); !errors.As(err, &cerr) || cerr.Reason != "checksum mismatch" {
+		t.Errorf("Open: got error %v, want checksum mismatch", err)
+	}
+	mi, err := OpenWithOptions(bad, bad, OpenOptions{SkipVerify: true})
+	if err != nil {
+		t.Errorf("OpenWithOptions with SkipVerify: %v", err)
+	} else {
+		mi.Close()
+	}
+	if err := Verify(bad); !errors.As(err, &cerr) || cerr.Reason != "checksum mismatch" {
+		t.Errorf("Verify(bad): got error %v, want checksum mismatch", err)
+	}
+	if err := Verify(good); err != nil {
+		t.Errorf("Verify(good): %v", err)
+	}
+}
+
+// rehash updates the length and checksum in the header of the index in
+// data to match its contents, so that a deliberately corrupted index
+// can be opened.
+func rehash(data []byte) {
+	h, err := parseHeader(data)
+	if err != nil || !h.hasChecksum() {
+		return
+	}
+	binary.LittleEndian.PutUint32(data[h.lengthPos():], uint32(len(data)))
+	sum := sha256.Sum256(data[h.size():])
+	copy(data[h.hashPos():], sum[:])
+}
+
+// sourceFileOffsetPos returns the offset of the pointer to the first
+// source file in the record of the package in dir.
+func sourceFileOffsetPos(mi *ModuleIndex, dir string) uint32 {
+	d := decoderAt{pos: mi.packages[dir].offset, mi: mi}
+	d.int() // error
+	d.int() // path
+	d.int() // dir
+	d.int() // number of source files
+	return d.pos
+}
+
+// insertRecord inserts record into the index in data just before its
+// string table, and points the pointer at ptrPos to it.
+func insertRecord(mi *ModuleIndex, data []byte, ptrPos uint32, record []byte) []byte {
+	h := newIndexHeader(mi.version)
+	stringTableOffsetPos := h.size()
+	if h.hasFlags() {
+		stringTableOffsetPos += 4
+	}
+	at := binary.LittleEndian.Uint32(data[stringTableOffsetPos:])
+	data = append(data[:at:at], append(record, data[at:]...)...)
+	binary.LittleEndian.PutUint32(data[stringTableOffsetPos:], at+uint32(len(record)))
+	binary.LittleEndian.PutUint32(data[ptrPos:], at)
+	return data
+}
+
+func TestCorruptIndex(t *testing.T) {
+	fixed := EncodeOptions{Version: CurrentVersion}
+	compact := EncodeOptions{Version: CurrentVersion, Compact: true}
+
+	// Each corruption is of the package in directory "a", or of its
+	// first source file. mi is the uncorrupted index, used to find the
+	// offsets of the values to corrupt.
+	tests := []struct {
+		name     string
+		opts     EncodeOptions
+		corrupt  func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte
+		reason   string // expected in the CorruptIndexError's Reason
+		atOpen   bool   // Open reports the error
+		noRehash bool   // leave the header's length and checksum alone
+		noTags   bool   // PackageTags doesn't read the corrupt value
+	}{
+		{
+			name: "truncated",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			reason:   "does not match file size",
+			noRehash: true,
+			atOpen:   true,
+		},
+		{
+			name: "truncated/v0",
+			opts: EncodeOptions{Version: Version0},
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				return data[:len(data)/2]
+			},
+			reason: "past end of index",
+			atOpen: true,
+		},
+		{
+			name: "unknown flags",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				binary.LittleEndian.PutUint32(data[newIndexHeader(mi.version).size():], 1<<20)
+				return data
+			},
+			reason: "unknown index flags",
+			atOpen: true,
+		},
+		{
+			name: "bad bool",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				binary.LittleEndian.PutUint32(data[sf.offset+4*sourceFileIgnoreFile:], 2)
+				return data
+			},
+			reason: "invalid bool value",
+			noTags: true,
+		},
+		{
+			name: "bad string offset",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				binary.LittleEndian.PutUint32(data[sf.offset+4*sourceFileName:], 0xfffffff0)
+				return data
+			},
+			reason: "past end of string table",
+		},
+		{
+			name: "oversized count",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				pos := sourceFileOffsetPos(mi, "a") - 4
+				binary.LittleEndian.PutUint32(data[pos:], 1<<30)
+				return data
+			},
+			reason: "exceeds size of index",
+		},
+		{
+			name: "bad varint",
+			opts: compact,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				copy(data[sf.offset:], bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64))
+				return data
+			},
+			reason: "invalid varint",
+		},
+		{
+			name: "bad expression kind",
+			opts: fixed,
+			corrupt: func(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+				pos, _ := sf.constraintsOffset()
+				binary.LittleEndian.PutUint32(data[pos+4:], 9) // after the error string
+				return data
+			},
+			reason: "invalid build constraint expression kind",
+		},
+		{
+			name:    "deep expression",
+			opts:    fixed,
+			corrupt: deepExpression,
+			reason:  "nested too deeply",
+		},
+		{
+			name:    "deep expression/compact",
+			opts:    compact,
+			corrupt: deepExpression,
+			reason:  "nested too deeply",
+		},
+	}
+
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeTestIndex(t, moddir, tt.opts)
+			mi := openTestIndex(t, append([]byte(nil), data...), moddir)
+			rp, _, err := mi.RawPackage("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.corrupt(mi, &rp.SourceFiles[0], data)
+			if !tt.noRehash {
+				rehash(data)
+			}
+
+			file := filepath.Join(t.TempDir(), "go.index")
+			if err := os.WriteFile(file, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			var cerr *CorruptIndexError
+			mi, err = Open(file, filepath.Join(moddir, "go.index"))
+			if tt.atOpen {
+				if !errors.As(err, &cerr) || !strings.Contains(cerr.Reason, tt.reason) {
+					t.Errorf("Open: got error %v, want *CorruptIndexError: %s", err, tt.reason)
+				}
+				if _, err := OpenWithOptions(file, filepath.Join(moddir, "go.index"), OpenOptions{SkipVerify: true}); !errors.As(err, &cerr) {
+					t.Errorf("OpenWithOptions: got error %v, want *CorruptIndexError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer mi.Close()
+
+			dir := filepath.Join(moddir, "a")
+			if _, err := mi.ImportPackage(build.Default, dir, 0); !errors.As(err, &cerr) || !strings.Contains(cerr.Reason, tt.reason) {
+				t.Errorf("ImportPackage: got error %v, want *CorruptIndexError: %s", err, tt.reason)
+			}
+			if _, err := mi.PlatformMatrix(dir, nil); !errors.As(err, &cerr) {
+				t.Errorf("PlatformMatrix: got error %v, want *CorruptIndexError", err)
+			}
+			if _, err := mi.PackageTags(dir); !tt.noTags && !errors.As(err, &cerr) {
+				t.Errorf("PackageTags: got error %v, want *CorruptIndexError", err)
+			}
+		})
+	}
+}
+
+// deepExpression replaces sf with a copy whose //go:build expression is
+// nested more deeply than the decoder allows.
+func deepExpression(mi *ModuleIndex, sf *SourceFile, data []byte) []byte {
+	start := sf.offset
+	end, err := sf.constraintsOffset()
+	if err != nil {
+		panic(err)
+	}
+	e := newEncoder(newIndexHeader(mi.version))
+	e.compact = mi.compact
+	e.Bytes(data[start:end])
+	e.Int(0) // error
+	for i := 0; i <= maxExprDepth+1; i++ {
+		e.Int(exprNot)
+	}
+	e.Int(exprTag)
+	e.Int(0) // tag
+	e.Int(0) // number of plus build expressions
+	e.Int(0) // number of tags
+	e.Int(0) // number of mentioned tags
+	return insertRecord(mi, data, sourceFileOffsetPos(mi, "a"), e.buf.Bytes())
+}
+
+// openIndexData opens the index in data against moddir without
+// verifying its checksum, as OpenWithOptions does with SkipVerify.
+func openIndexData(data []byte, moddir string) (*ModuleIndex, error) {
+	mi := &ModuleIndex{data: data, moddir: moddir}
+	if err := mi.readHeader(false); err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+// TestCorruptIndexNoPanic flips each byte of an index in turn and checks
+// that reading the result reports errors rather than panicking.
+func TestCorruptIndexNoPanic(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	for _, opts := range testEncodeOptions {
+		data := encodeTestIndex(t, moddir, opts)
+		for i := range data {
+			corrupt := append([]byte(nil), data...)
+			corrupt[i] ^= 0xff
+			if err := readCorruptIndex(corrupt, moddir); err != nil {
+				t.Errorf("%s: byte %d flipped: %v", encodingName(opts), i, err)
+			}
+		}
+	}
+}
+
+// readCorruptIndex reads everything in the index in data, returning an
+// error if doing so panics.
+func readCorruptIndex(data []byte, moddir string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	mi, err := openIndexData(data, moddir)
+	if err != nil {
+		return nil
+	}
+	NewTagInventory().AddModule(mi)
+	for _, dir := range mi.packageDirs() {
+		mi.ImportPackage(build.Default, filepath.Join(moddir, filepath.FromSlash(dir)), 0)
+		mi.PackageTags(dir)
+	}
+	return nil
+}
+
+// TestOpenNoMmap checks that an index read into memory, rather than
+// mapped, gives the same results as a mapped one, and is unaffected by
+// the index file being rewritten while it's open.
+func TestOpenNoMmap(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	file := filepath.Join(t.TempDir(), "go.index")
+	if err := os.WriteFile(file, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	futurepath := filepath.Join(moddir, "go.index")
+
+	mapped, err := Open(file, futurepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := importAll(mapped, moddir)
+	mapped.Close()
+
+	mi, err := OpenWithOptions(file, futurepath, OpenOptions{NoMmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mi.Close()
+	if mi.mapped {
+		t.Fatalf("index opened with NoMmap is mapped")
+	}
+	if err := os.Truncate(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := importAll(mi, moddir); !reflect.DeepEqual(got, want) {
+		t.Errorf("index read into memory gives different results from mapped index")
+	}
+}
@@ -1,35 +1,320 @@
 package index
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
+	"go/build/constraint"
 	"go/token"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 )
 
-// Todo(matloob) write straight to file? Much easier to poke in the
+// Index format versions.
+//
+// Compatibility policy: Open reads every version from Version0 through
+// CurrentVersion and reports an *IndexTooNewError for anything newer.
+// EncodeModuleWithOptions can produce any of these versions, so a
+// toolchain can write indexes that older toolchains sharing the same
+// cache are still able to read. Adding data to the index requires a
+// new version; the decoder supports older versions by treating the
+// data they lack as absent. The exception is the module metadata
+// table, whose entries are keyed by name: new keys may be added
+// without a new version, and readers ignore keys they don't know.
+const (
+	Version0 = 0 // original format: magic string followed directly by the body
+	Version1 = 1 // adds the total length and a SHA-256 checksum to the header
+	Version2 = 2 // adds a flags word to the start of the body, allowing the compact encoding
+	Version3 = 3 // drops filenames from positions; they're always the containing file
+	Version4 = 4 // keys packages by module-relative directory and drops absolute directories
+	Version5 = 5 // adds a table of module metadata, such as the module path
+	Version6 = 6 // adds parsed build constraints, and the tags they mention, to source files
+	Version7 = 7 // adds every build tag mentioned by each source file and package
+
+	CurrentVersion = Version7
+)
+
+// The index begins with the magic string "go index vN\n", where N is
+// the decimal format version. From Version1 on, the magic string is
+// followed by the total length of the index and a SHA-256 hash of
+// everything following the header. Offsets in the index are from the
+// start of the file, including the header.
+//
+// From Version2 on, the body begins with a four-byte flags word
+// describing how the rest of the index is encoded. From Version5 on,
+// the string table offset is followed by the module metadata table:
+// a count followed by that many key and value strings.
+const indexMagicPrefix = "go index v"
+
+const (
+	indexFlagCompact = 1 << iota // values are varints; see EncodeOptions.Compact
+
+	indexFlagsMask = indexFlagCompact
+)
+
+// Flags packed into the IgnoreFile field of source files in the compact encoding.
+const (
+	sourceFileFlagIgnoreFile = 1 << iota
+	sourceFileFlagBinaryOnly
+)
+
+type indexHeader struct {
+	version int
+	magic   string
+}
+
+func newIndexHeader(version int) indexHeader {
+	return indexHeader{version: version, magic: indexMagicPrefix + strconv.Itoa(version) + "\n"}
+}
+
+func (h indexHeader) hasChecksum() bool { return h.version >= Version1 }
+
+func (h indexHeader) hasFlags() bool { return h.version >= Version2 }
+
+func (h indexHeader) hasMetadata() bool { return h.version >= Version5 }
+
+func (h indexHeader) lengthPos() int { return len(h.magic) }
+
+func (h indexHeader) hashPos() int { return h.lengthPos() + 4 }
+
+// size returns the size of the header. The body of the index follows it.
+func (h indexHeader) size() int {
+	if !h.hasChecksum() {
+		return len(h.magic)
+	}
+	return h.hashPos() + sha256.Size
+}
+
+// Keys of the module metadata table.
+const (
+	metadataModulePath    = "module"
+	metadataModuleVersion = "version"
+	metadataGoMod         = "gomod"   // contents of go.mod
+	metadataGoVersion     = "go"      // version from go.mod's go directive
+	metadataRequire       = "require" // go.mod's requirements, one "path version" per line
+	metadataNested        = "nested"  // directories of nested modules, one per line
+)
+
+type metadataEntry struct {
+	key, value string
+}
+
+// metadata returns the entries of the module metadata table
+// describing rm, sorted by key.
+func (rm *RawModule) metadata() []metadataEntry {
+	if rm == nil {
+		return nil
+	}
+	var meta []metadataEntry
+	if rm.Path != "" {
+		meta = append(meta, metadataEntry{metadataModulePath, rm.Path})
+	}
+	if rm.Version != "" {
+		meta = append(meta, metadataEntry{metadataModuleVersion, rm.Version})
+	}
+	if gomod := rm.GoMod; gomod != nil {
+		meta = append(meta, metadataEntry{metadataGoMod, string(gomod.Data)})
+		if gomod.Go != "" {
+			meta = append(meta, metadataEntry{metadataGoVersion, gomod.Go})
+		}
+		if len(gomod.Require) > 0 {
+			var require strings.Builder
+			for _, r := range gomod.Require {
+				fmt.Fprintf(&require, "%s %s\n", r.Path, r.Version)
+			}
+			meta = append(meta, metadataEntry{metadataRequire, require.String()})
+		}
+	}
+	if len(rm.Nested) > 0 {
+		nested := append([]string(nil), rm.Nested...)
+		sort.Strings(nested)
+		meta = append(meta, metadataEntry{metadataNested, strings.Join(nested, "\n")})
+	}
+	sort.Slice(meta, func(i, j int) bool { return meta[i].key < meta[j].key })
+	return meta
+}
+
+// EncodeOptions controls the index produced by EncodeModuleWithOptions.
+type EncodeOptions struct {
+	// Version is the index format version to produce. It must be
+	// between Version0 and CurrentVersion.
+	Version int
+
+	// Compact selects a smaller encoding of the index, in which
+	// numbers are written as varints rather than four-byte values,
+	// a source file's IgnoreFile and BinaryOnly fields are packed
+	// into a single flags value, and positions are delta-encoded.
+	// Offsets within the index keep their four-byte encoding.
+	// Open detects the encoding automatically. Compact requires
+	// Version2 or later.
+	Compact bool
+}
+
+// EncodeModule encodes packages as a module index in the current format.
+// moddir is the root directory of the module containing the packages.
 func EncodeModule(packages []*RawPackage, moddir string) ([]byte, error) {
-	// fix up dir
-	for i := range packages {
-		rel, err := filepath.Rel(moddir, packages[i].Dir)
+	return EncodeModuleWithOptions(packages, moddir, EncodeOptions{Version: CurrentVersion})
+}
+
+// EncodeModuleWithOptions is like EncodeModule but encodes the index
+// as specified by opts.
+func EncodeModuleWithOptions(packages []*RawPackage, moddir string, opts EncodeOptions) ([]byte, error) {
+	e, err := encodeModule(packages, nil, moddir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return e.encodedBytes()
+}
+
+// EncodeRawModule encodes the packages of rm as a module index, as specified
+// by opts. Unlike EncodeModule, it also records information about the
+// module itself, such as its module path. moddir is the root directory
+// of the module.
+func EncodeRawModule(rm *RawModule, moddir string, opts EncodeOptions) ([]byte, error) {
+	e, err := encodeModule(rm.packages(), rm, moddir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return e.encodedBytes()
+}
+
+// WriteModuleIndex encodes packages as a module index in the current
+// format and writes it to the file at path. The index is written to a
+// temporary file in the same directory, synced, and renamed into place,
+// so readers of path see either the old index or the complete new one.
+// On Unix systems the directory is then synced so that the rename is
+// durable; elsewhere, a crash soon after writing may lose the new index.
+func WriteModuleIndex(path string, packages []*RawPackage, moddir string) error {
+	e, err := encodeModule(packages, nil, moddir, EncodeOptions{Version: CurrentVersion})
+	if err != nil {
+		return err
+	}
+	return e.writeFile(path)
+}
+
+// WriteRawModule is like EncodeRawModule, but writes the index to the
+// file at path in the same way as WriteModuleIndex.
+func WriteRawModule(path string, rm *RawModule, moddir string, opts EncodeOptions) error {
+	e, err := encodeModule(rm.packages(), rm, moddir, opts)
+	if err != nil {
+		return err
+	}
+	return e.writeFile(path)
+}
+
+// encodedBytes returns the complete index.
+func (e *encoder) encodedBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(e.Len())
+	if _, err := e.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFile atomically writes the complete index to the file at path.
+func (e *encoder) writeFile(path string) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if _, err := e.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// encodeModule encodes the index into an encoder, leaving the header's
+// length and checksum to be filled in by the encoder's WriteTo method.
+// Information about the module is taken from rm if it is non-nil.
+func encodeModule(packages []*RawPackage, rm *RawModule, moddir string, opts EncodeOptions) (*encoder, error) {
+	if opts.Version < Version0 || opts.Version > CurrentVersion {
+		return nil, fmt.Errorf("cannot encode module index: unsupported version %d", opts.Version)
+	}
+	h := newIndexHeader(opts.Version)
+	if opts.Compact && !h.hasFlags() {
+		return nil, fmt.Errorf("cannot encode module index: compact encoding requires version %d or later", Version2)
+	}
+
+	// Make Dir relative to the module. Work on shallow copies of the
+	// packages so that the caller's packages and slice aren't modified
+	// and can be encoded again.
+	packages = append([]*RawPackage(nil), packages...)
+	for i, p := range packages {
+		rel, err := filepath.Rel(moddir, p.Dir)
 		if err != nil {
 			return nil, err
 		}
-		packages[i].Dir = rel
+		cp := *p
+		cp.Dir = rel
+		packages[i] = &cp
 	}
 
-	e := newEncoder()
-	e.Bytes([]byte("go index v0\n"))
+	e := newEncoder(h)
+	e.Bytes([]byte(h.magic))
+	if h.hasChecksum() {
+		e.Uint32(0)                        // total length, filled in at the end
+		e.Bytes(make([]byte, sha256.Size)) // hash, filled in at the end
+	}
+	if h.hasFlags() {
+		var flags uint32
+		if opts.Compact {
+			flags |= indexFlagCompact
+		}
+		e.Uint32(flags)
+		e.compact = opts.Compact
+	}
 	stringTableOffsetPos := e.Pos() // fill this at the end
 	e.Uint32(0)                     // string table offset
-	e.Uint32(uint32(len(packages)))
-	sort.Slice(packages, func(i, j int) bool {
+	if h.hasMetadata() {
+		meta := rm.metadata()
+		e.Int(len(meta))
+		for _, kv := range meta {
+			if strings.IndexByte(kv.value, 0) >= 0 {
+				return nil, fmt.Errorf("module metadata %q contains a NUL byte", kv.key)
+			}
+			e.String(kv.key)
+			e.String(kv.value)
+		}
+	}
+	e.Int(len(packages))
+	sort.SliceStable(packages, func(i, j int) bool {
 		return packages[i].Dir < packages[j].Dir
 	})
 	for _, p := range packages {
-		e.String(p.SrcDir)
+		if h.version < Version4 {
+			e.String(p.SrcDir)
+		} else {
+			e.String(filepath.ToSlash(p.Dir))
+		}
 	}
 	packagesOffsetPos := make([]uint32, len(packages))
 	for i := range packages {
@@ -41,21 +326,35 @@ func EncodeModule(packages []*RawPackage, moddir string) ([]byte, error) {
 		writePackage(e, p)
 	}
 	e.Uint32At(e.Pos(), stringTableOffsetPos)
-	io.Copy(&e.buf, &e.stringTable)
-	return e.buf.Bytes(), nil
+	return e, nil
 }
 
 func writePackage(e *encoder, p *RawPackage) {
 	e.String(p.Error)
 	e.String(p.Path)
-	e.String(p.SrcDir)
-	e.String(p.Dir)
-	e.Uint32(uint32(len(p.SourceFiles)))                      // number of source files
+	if e.header.version < Version4 {
+		e.String(p.SrcDir)
+		e.String(p.Dir)
+	} else {
+		e.String(filepath.ToSlash(p.Dir))
+	}
+	e.Int(len(p.SourceFiles))                                 // number of source files
 	sourceFileOffsetPos := make([]uint32, len(p.SourceFiles)) // where to place the ith source file's offset
 	for i := range p.SourceFiles {
 		sourceFileOffsetPos[i] = e.Pos()
 		e.Uint32(0)
 	}
+	if e.header.version >= Version7 {
+		var tags []string
+		for _, f := range p.SourceFiles {
+			tags = append(tags, f.mentionedTags()...)
+		}
+		tags = sortedUnique(tags)
+		e.Int(len(tags))
+		for _, tag := range tags {
+			e.String(tag)
+		}
+	}
 	for i, f := range p.SourceFiles {
 		e.Uint32At(e.Pos(), sourceFileOffsetPos[i])
 		writeSourceFile(e, f)
@@ -68,18 +367,30 @@ func writeSourceFile(e *encoder, p *TaggedFile) {
 	e.String(p.Synopsis)
 	e.String(p.Name)
 	e.String(p.PkgName)
-	e.Bool(p.IgnoreFile)
-	e.Bool(p.BinaryOnly)
+	if e.compact {
+		var flags int
+		if p.IgnoreFile {
+			flags |= sourceFileFlagIgnoreFile
+		}
+		if p.BinaryOnly {
+			flags |= sourceFileFlagBinaryOnly
+		}
+		e.Int(flags)
+	} else {
+		e.Bool(p.IgnoreFile)
+		e.Bool(p.BinaryOnly)
+	}
 	e.String(p.QuotedImportComment)
-	e.Uint32(uint32(p.QuotedImportCommentLine))
+	e.Int(p.QuotedImportCommentLine)
 	e.String(p.GoBuildConstraint)
 
-	e.Uint32(uint32(len(p.PlusBuildConstraints)))
+	e.Int(len(p.PlusBuildConstraints))
 	for _, s := range p.PlusBuildConstraints {
 		e.String(s)
 	}
 
-	e.Uint32(uint32(len(p.Imports)))
+	e.Int(len(p.Imports))
+	e.resetPosition()
 	for _, m := range p.Imports {
 		e.String(m.Path)
 		e.String(m.Doc) // TODO(matloob): only save for cgo?
@@ -87,18 +398,99 @@ func writeSourceFile(e *encoder, p *TaggedFile) {
 	}
 	// TODO(matloob) produce the slice earlier
 
+	// Visit the patterns in sorted order so that the index, including
+	// the layout of its string table, is the same on every run.
+	patterns := make([]string, 0, len(p.Embeds))
+	for pattern := range p.Embeds {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
 	var embeds []embed
-	for pattern, positions := range p.Embeds {
-		for _, position := range positions {
+	for _, pattern := range patterns {
+		for _, position := range p.Embeds[pattern] {
 			embeds = append(embeds, embed{pattern, position})
 		}
 	}
-	e.Uint32(uint32(len(embeds)))
+	e.Int(len(embeds))
+	e.resetPosition()
 	for _, embed := range embeds {
 		e.String(embed.pattern)
 		e.Position(embed.position)
 
 	}
+
+	if e.header.version >= Version6 {
+		c := p.constraints()
+		e.String(c.err)
+		e.Expr(c.goBuild)
+		e.Int(len(c.plusBuild))
+		for _, x := range c.plusBuild {
+			e.Expr(x)
+		}
+		e.Int(len(c.tags))
+		for _, tag := range c.tags {
+			e.String(tag)
+		}
+	}
+	if e.header.version >= Version7 {
+		tags := p.mentionedTags()
+		e.Int(len(tags))
+		for _, tag := range tags {
+			e.String(tag)
+		}
+	}
+}
+
+// constraints returns the parsed build constraints of the file.
+func (tf *TaggedFile) constraints() parsedConstraints {
+	return parseConstraints(tf.Name, tf.GoBuildConstraint, tf.PlusBuildConstraints)
+}
+
+// mentionedTags returns the build tags mentioned by the file.
+func (tf *TaggedFile) mentionedTags() []string {
+	importsC := false
+	for _, imp := range tf.Imports {
+		if imp.Path == "C" {
+			importsC = true
+		}
+	}
+	c := tf.constraints()
+	return mentionedTags(tf.Name, &c, importsC)
+}
+
+// Kinds of nodes in an encoded build constraint expression. An
+// expression is written in prefix order: each node's kind is followed
+// by the tag name for a tag, or by its operands for an operator.
+const (
+	exprNone = iota // no expression
+	exprTag
+	exprNot
+	exprAnd
+	exprOr
+)
+
+// Expr writes a build constraint expression, which may be nil.
+func (e *encoder) Expr(x constraint.Expr) {
+	switch x := x.(type) {
+	case nil:
+		e.Int(exprNone)
+	case *constraint.TagExpr:
+		e.Int(exprTag)
+		e.String(x.Tag)
+	case *constraint.NotExpr:
+		e.Int(exprNot)
+		e.Expr(x.X)
+	case *constraint.AndExpr:
+		e.Int(exprAnd)
+		e.Expr(x.X)
+		e.Expr(x.Y)
+	case *constraint.OrExpr:
+		e.Int(exprOr)
+		e.Expr(x.X)
+		e.Expr(x.Y)
+	default:
+		panic(fmt.Sprintf("unexpected build constraint expression %T", x))
+	}
 }
 
 type embed struct {
@@ -106,8 +498,8 @@ type embed struct {
 	position token.Position
 }
 
-func newEncoder() *encoder {
-	e := &encoder{strings: make(map[string]uint32)}
+func newEncoder(h indexHeader) *encoder {
+	e := &encoder{header: h, strings: make(map[string]uint32)}
 
 	// place the empty string at position 0 in the string table
 	e.stringTable.WriteByte(0)
@@ -116,17 +508,64 @@ func newEncoder() *encoder {
 	return e
 }
 
+// Position writes a position. From Version3 on, the filename is left
+// out: it is always the file containing the position, and is
+// reconstructed from the directory the index is opened against.
+// In the compact encoding, the offset and line are written as deltas
+// from the previous position in the same list.
 func (e *encoder) Position(position token.Position) {
-	e.String(position.Filename)
-	e.Uint32(uint32(position.Offset))
-	e.Uint32(uint32(position.Line))
-	e.Uint32(uint32(position.Column))
+	if e.header.version < Version3 {
+		e.String(position.Filename)
+	}
+	if e.compact {
+		e.Varint(position.Offset - e.prevOffset)
+		e.Varint(position.Line - e.prevLine)
+		e.prevOffset, e.prevLine = position.Offset, position.Line
+	} else {
+		e.Int(position.Offset)
+		e.Int(position.Line)
+	}
+	e.Int(position.Column)
+}
+
+// resetPosition starts a new list of delta-encoded positions.
+func (e *encoder) resetPosition() {
+	e.prevOffset, e.prevLine = 0, 0
 }
 
 type encoder struct {
+	header      indexHeader
+	compact     bool
 	buf         bytes.Buffer
 	stringTable bytes.Buffer
 	strings     map[string]uint32
+
+	prevOffset, prevLine int // previous position written, for delta encoding
+}
+
+// Len returns the total length of the encoded index.
+func (e *encoder) Len() int {
+	return e.buf.Len() + e.stringTable.Len()
+}
+
+// WriteTo completes the index header and writes the index to w.
+// The string table is written directly after the rest of the index
+// rather than being copied onto the end of it.
+func (e *encoder) WriteTo(w io.Writer) (int64, error) {
+	h := e.header
+	if h.hasChecksum() {
+		e.Uint32At(uint32(e.Len()), uint32(h.lengthPos()))
+		hash := sha256.New()
+		hash.Write(e.buf.Bytes()[h.size():])
+		hash.Write(e.stringTable.Bytes())
+		copy(e.buf.Bytes()[h.hashPos():], hash.Sum(nil))
+	}
+	n, err := w.Write(e.buf.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(e.stringTable.Bytes())
+	return int64(n + m), err
 }
 
 func (e *encoder) Pos() uint32 {
@@ -139,12 +578,12 @@ func (e *encoder) Bytes(b []byte) {
 
 func (e *encoder) String(s string) {
 	if n, ok := e.strings[s]; ok {
-		e.Uint32(n)
+		e.Int(int(n))
 		return
 	}
 	pos := uint32(e.stringTable.Len())
 	e.strings[s] = pos
-	e.Uint32(pos)
+	e.Int(int(pos))
 	e.stringTable.Write([]byte(s))
 	e.stringTable.WriteByte(0)
 }
@@ -157,6 +596,25 @@ func (e *encoder) Bool(b bool) {
 	}
 }
 
+// Int writes an unsigned value: a varint in the compact encoding,
+// and a four-byte value otherwise.
+func (e *encoder) Int(n int) {
+	if !e.compact {
+		e.Uint32(uint32(n))
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+// Varint writes a signed varint. It is only used by the compact encoding.
+func (e *encoder) Varint(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutVarint(buf[:], int64(n))])
+}
+
+// Uint32 writes a four-byte value. Offsets within the index are always
+// written this way, so that they can be filled in after they're written.
 func (e *encoder) Uint32(n uint32) {
 	binary.Write(&e.buf, binary.LittleEndian, n)
 }
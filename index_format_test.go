@@ -0,0 +1,193 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testPackages indexes the module in moddir and returns its packages in
+// reverse order of directory, so that encoding has to sort them.
+func testPackages(t testing.TB, moddir string) []*RawPackage {
+	t.Helper()
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgs []*RawPackage
+	for _, p := range rm.Dirs {
+		pkgs = append(pkgs, p)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Dir > pkgs[j].Dir })
+	return pkgs
+}
+
+func TestEncodeModuleTwice(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	pkgs := testPackages(t, moddir)
+	order := append([]*RawPackage(nil), pkgs...)
+	var dirs []string
+	for _, p := range pkgs {
+		dirs = append(dirs, p.Dir)
+	}
+
+	first, err := EncodeModule(pkgs, moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EncodeModule(pkgs, moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("encoding the same packages twice produced different indexes")
+	}
+	for i, p := range pkgs {
+		if p != order[i] {
+			t.Errorf("packages[%d] was reordered: got %s, want %s", i, p.Dir, order[i].Dir)
+		}
+		if p.Dir != dirs[i] {
+			t.Errorf("packages[%d].Dir was modified: got %q, want %q", i, p.Dir, dirs[i])
+		}
+	}
+}
+
+// TestEncodeDeterministic checks that the index of a module is the same
+// every time it's encoded, although the packages and embed patterns are
+// held in maps whose iteration order varies.
+func TestEncodeDeterministic(t *testing.T) {
+	const runs = 20
+
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	for _, opts := range testEncodeOptions {
+		var want [sha256.Size]byte
+		for i := 0; i < runs; i++ {
+			rm, err := IndexModule(moddir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 2; j++ {
+				if j == 1 {
+					// Rebuild the map of directories, and the embeds
+					// of each file, in a new order.
+					dirs := make(map[string]*RawPackage)
+					for dir, p := range rm.Dirs {
+						for _, f := range p.SourceFiles {
+							embeds := make(map[string][]token.Position)
+							for pattern, pos := range f.Embeds {
+								embeds[pattern] = pos
+							}
+							f.Embeds = embeds
+						}
+						dirs[dir] = p
+					}
+					rm.Dirs = dirs
+				}
+				data, err := EncodeRawModule(rm, moddir, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sum := sha256.Sum256(data)
+				if i == 0 && j == 0 {
+					want = sum
+				} else if sum != want {
+					t.Fatalf("compact=%v: encoding %d.%d has hash %x, want %x", opts.Compact, i, j, sum, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeOptionsInvalid(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	pkgs := testPackages(t, moddir)
+	for _, opts := range []EncodeOptions{
+		{Version: CurrentVersion + 1},
+		{Version: Version0 - 1},
+		{Version: Version1, Compact: true},
+	} {
+		if _, err := EncodeModuleWithOptions(pkgs, moddir, opts); err == nil {
+			t.Errorf("EncodeModuleWithOptions(%+v) succeeded, want error", opts)
+		}
+	}
+}
+
+// TestWriteModuleIndex checks that WriteModuleIndex writes the same
+// index as EncodeModule, replaces an existing file, and leaves no
+// temporary file behind whether or not it succeeds.
+func TestWriteModuleIndex(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	pkgs := testPackages(t, moddir)
+	want, err := EncodeModule(pkgs, moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "go.index")
+	if err := os.WriteFile(file, []byte("old index"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteModuleIndex(file, pkgs, moddir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("WriteModuleIndex wrote a different index from EncodeModule")
+	}
+
+	// A directory can't be replaced by a file, so the rename fails
+	// after the temporary file is written.
+	notFile := filepath.Join(dir, "dir.index")
+	if err := os.MkdirAll(filepath.Join(notFile, "x"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteModuleIndex(notFile, pkgs, moddir); err == nil {
+		t.Errorf("WriteModuleIndex over a directory succeeded")
+	}
+
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) > 0 {
+		t.Errorf("temporary files left behind: %q", tmps)
+	}
+}
+
+// BenchmarkEncode compares the fixed-width and compact encodings of this
+// module's index. The size of the index is reported as index-bytes.
+func BenchmarkEncode(b *testing.B) {
+	moddir, err := filepath.Abs(".")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, opts := range testEncodeOptions {
+		b.Run(encodingName(opts), func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				data, err := EncodeRawModule(rm, moddir, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "index-bytes")
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package index
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testModule is a small module that exercises most of what an index
+// records: build constraints, embeds, cgo directives, test files, import
+// comments, multiple packages in a directory, and directories that are
+// left out of the index.
+var testModule = map[string]string{
+	"go.mod": "module example.com/m\n\ngo 1.18\n\nrequire golang.org/x/mod v0.5.1\n",
+
+	"a/a.go": `// Package a does things.
+package a // import "example.com/m/a"
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+)
+
+//go:embed a.go
+var s string
+
+//go:embed b.txt a.go
+var t string
+
+var _ = fmt.Println
+var _ = os.Exit
+`,
+	"a/a_linux.go": "package a\n\nimport \"strings\"\n\nvar _ = strings.Cut\n",
+	"a/a_test.go":  "package a_test\n\nimport \"testing\"\n\nfunc TestX(t *testing.T) {}\n",
+	"a/b.txt":      "hi\n",
+	"a/plus.go":    "// +build darwin,amd64 windows\n\npackage a\n",
+	"a/tag.go":     "//go:build foo && !bar || linux\n\npackage a\n",
+
+	"b/b.go": "package b\n",
+	"b/c.go": `package b
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/inc -Iinc2
+#cgo linux LDFLAGS: -L lib
+#include <stdio.h>
+*/
+import "C"
+
+import "fmt"
+
+var _ = fmt.Sprint
+`,
+	"b/x.c":              "",
+	"b/y.S":              "",
+	"b/z.h":              "",
+	"b/testdata/t.go":    "package td\n",
+	"c/c.go":             "package c\n",
+	"c/d.go":             "package d\n",
+	"d/bad.go":           "//go:build foo &&\n\npackage a\n",
+	"d/ok.go":            "package d\n",
+	"_skip/s.go":         "package skip\n",
+	"nested/go.mod":      "module example.com/m/nested\n",
+	"nested/n.go":        "package nested\n",
+	"vendor/x/x.go":      "package x\n",
+	"vendor/modules.txt": "",
+}
+
+// testPackageDirs are the module-relative directories of testModule
+// that are indexed by default.
+var testPackageDirs = []string{".", "a", "b", "c", "d"}
+
+// writeTestModule writes the files of testModule into dir.
+func writeTestModule(t testing.TB, dir string) {
+	t.Helper()
+	for name, data := range testModule {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// encodeTestIndex indexes the module in moddir and encodes it with opts.
+func encodeTestIndex(t testing.TB, moddir string, opts EncodeOptions) []byte {
+	t.Helper()
+	rm, err := IndexModule(moddir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeRawModule(rm, moddir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// openTestIndex writes the index data to a temporary file and opens it
+// against moddir. The index is closed when the test finishes.
+func openTestIndex(t testing.TB, data []byte, moddir string) *ModuleIndex {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "go.index")
+	if err := os.WriteFile(file, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	mi, err := Open(file, filepath.Join(moddir, "go.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mi.Close() })
+	return mi
+}
+
+// testContexts returns build contexts that between them select every
+// file of testModule.
+func testContexts() []build.Context {
+	var ctxts []build.Context
+	for _, goos := range []string{"linux", "darwin", "windows"} {
+		for _, cgo := range []bool{true, false} {
+			ctxt := build.Default
+			ctxt.GOOS, ctxt.GOARCH, ctxt.CgoEnabled = goos, "amd64", cgo
+			ctxt.BuildTags = []string{"foo"}
+			ctxts = append(ctxts, ctxt)
+		}
+	}
+	return ctxts
+}
+
+var testEncodeOptions = []EncodeOptions{
+	{Version: CurrentVersion},
+	{Version: CurrentVersion, Compact: true},
+}
+
+type importResult struct {
+	p   *build.Package
+	err string
+}
+
+func importAll(mi *ModuleIndex, moddir string) []importResult {
+	var results []importResult
+	for _, dir := range testPackageDirs {
+		for _, ctxt := range testContexts() {
+			p, err := mi.ImportPackage(ctxt, filepath.Join(moddir, dir), build.ImportComment)
+			r := importResult{p: p}
+			if err != nil {
+				r.err = err.Error()
+			}
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// readAll decodes every package and source file record in the index.
+func readAll(mi *ModuleIndex) ([]*RawPackage2, []*rawFile, error) {
+	var pkgs []*RawPackage2
+	var files []*rawFile
+	for _, dir := range testPackageDirs {
+		rp, _, err := mi.RawPackage(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		pkgs = append(pkgs, rp)
+		for i := range rp.SourceFiles {
+			f, err := readRawFile(&rp.SourceFiles[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	return pkgs, files, nil
+}
+
+// TestConcurrentReads checks, when run with the race detector, that a
+// ModuleIndex can be read from many goroutines at once. Each goroutine's
+// results must match those of reading a separately opened copy of the
+// index serially.
+func TestConcurrentReads(t *testing.T) {
+	const goroutines = 16
+
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	for _, opts := range testEncodeOptions {
+		data := encodeTestIndex(t, moddir, opts)
+		serial := openTestIndex(t, data, moddir)
+		wantImports := importAll(serial, moddir)
+		wantPkgs, wantFiles, err := readAll(serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Use a fresh index so that the goroutines race to fill its
+		// string table.
+		mi := openTestIndex(t, data, moddir)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if i%2 == 0 {
+					if got := importAll(mi, moddir); !reflect.DeepEqual(got, wantImports) {
+						t.Errorf("compact=%v: concurrent ImportPackage results differ from serial results", opts.Compact)
+					}
+					return
+				}
+				pkgs, files, err := readAll(mi)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, p := range pkgs {
+					for j := range p.SourceFiles {
+						p.SourceFiles[j].mi = serial
+					}
+				}
+				if !reflect.DeepEqual(pkgs, wantPkgs) || !reflect.DeepEqual(files, wantFiles) {
+					t.Errorf("compact=%v: concurrent package records differ from serial results", opts.Compact)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+}
+
+func TestStringTableConcurrent(t *testing.T) {
+	st := newStringTable([]byte("\x00foo\x00bar\x00\x00baz\x00"), 0)
+	want := map[uint32]string{0: "", 1: "foo", 5: "bar", 9: "", 10: "baz", 6: "ar"}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos, s := range want {
+				got, err := st.String(pos)
+				if err != nil || got != s {
+					t.Errorf("String(%d) = %q, %v; want %q", pos, got, err, s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
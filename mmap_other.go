@@ -0,0 +1,18 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package index
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on this platform. Callers fall back to
+// reading the file into memory.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
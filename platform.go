@@ -0,0 +1,112 @@
+package index
+
+import (
+	"errors"
+	"go/build"
+	"sort"
+)
+
+// A Platform is a target operating system and architecture, with cgo
+// either enabled or disabled.
+type Platform struct {
+	GOOS       string
+	GOARCH     string
+	CgoEnabled bool
+}
+
+// PlatformSupport describes how a package builds on a Platform.
+type PlatformSupport struct {
+	Platform
+
+	// Buildable reports whether the package has Go files that build on
+	// the platform, and no errors.
+	Buildable bool
+
+	// Files lists the package's non-test source files that are
+	// included in the build on the platform, sorted by name.
+	Files []string
+
+	// Err is the error importing the package for the platform, if any.
+	// A package without buildable Go files has a *NoGoError.
+	Err error
+}
+
+// KnownPlatforms returns every combination of a known GOOS, a known
+// GOARCH and cgo disabled or enabled, in that order of significance.
+func KnownPlatforms() []Platform {
+	var goos, goarch []string
+	for os := range knownOS {
+		goos = append(goos, os)
+	}
+	for arch := range knownArch {
+		goarch = append(goarch, arch)
+	}
+	sort.Strings(goos)
+	sort.Strings(goarch)
+	var platforms []Platform
+	for _, os := range goos {
+		for _, arch := range goarch {
+			for _, cgo := range []bool{false, true} {
+				platforms = append(platforms, Platform{GOOS: os, GOARCH: arch, CgoEnabled: cgo})
+			}
+		}
+	}
+	return platforms
+}
+
+// PlatformMatrix reports, for each of KnownPlatforms, whether the package
+// in dir builds on the platform with the given build tags set, and which
+// of its files the build includes. dir is interpreted as by ImportPackage.
+// Other fields of the build contexts used are those of build.Default.
+func (mi *ModuleIndex) PlatformMatrix(dir string, buildTags []string) ([]PlatformSupport, error) {
+	if _, ok, err := mi.RawPackage(dir); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, mi.notFoundError(dir)
+	}
+
+	platforms := KnownPlatforms()
+	ctxts := make([]build.Context, len(platforms))
+	for i, pl := range platforms {
+		ctxt := build.Default
+		ctxt.GOOS = pl.GOOS
+		ctxt.GOARCH = pl.GOARCH
+		ctxt.CgoEnabled = pl.CgoEnabled
+		ctxt.BuildTags = buildTags
+		ctxts[i] = ctxt
+	}
+	pkgs, errs := mi.ImportPackageMulti(ctxts, dir, 0)
+	for _, err := range errs {
+		// The package's files are decoded once for all platforms, so a
+		// corrupt index is reported for the matrix as a whole.
+		var cerr *CorruptIndexError
+		if errors.As(err, &cerr) {
+			return nil, err
+		}
+	}
+
+	matrix := make([]PlatformSupport, len(platforms))
+	for i, p := range pkgs {
+		var files []string
+		for _, list := range [][]string{
+			p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles, p.HFiles,
+			p.FFiles, p.SFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles,
+		} {
+			files = append(files, list...)
+		}
+		sort.Strings(files)
+		err := errs[i]
+		if err == nil && len(p.GoFiles)+len(p.CgoFiles) == 0 {
+			// ImportPackage doesn't report a package with only test
+			// files, but it has nothing to build.
+			err = &NoGoError{p.Dir}
+		}
+		matrix[i] = PlatformSupport{
+			Platform:  platforms[i],
+			Buildable: err == nil,
+			Files:     files,
+			Err:       err,
+		}
+	}
+	return matrix, nil
+}
@@ -0,0 +1,71 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlatformMatrix(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	testonly := filepath.Join(moddir, "testonly")
+	if err := os.MkdirAll(testonly, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testonly, "x_test.go"), []byte("package testonly\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+
+	has := func(files []string, name string) bool {
+		for _, f := range files {
+			if f == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	a, err := mi.PlatformMatrix("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != len(KnownPlatforms()) {
+		t.Fatalf("PlatformMatrix returned %d platforms, want %d", len(a), len(KnownPlatforms()))
+	}
+	for _, ps := range a {
+		// As in the go command, android builds files for linux too.
+		if got, want := has(ps.Files, "a_linux.go"), ps.GOOS == "linux" || ps.GOOS == "android"; got != want {
+			t.Errorf("a on %v: a_linux.go included = %v, want %v", ps.Platform, got, want)
+		}
+		if !ps.Buildable || ps.Err != nil {
+			t.Errorf("a on %v: Buildable = %v, Err = %v; want buildable", ps.Platform, ps.Buildable, ps.Err)
+		}
+	}
+
+	b, err := mi.PlatformMatrix("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ps := range b {
+		if got, want := has(ps.Files, "c.go"), ps.CgoEnabled; got != want {
+			t.Errorf("b on %v: c.go included = %v, want %v", ps.Platform, got, want)
+		}
+		if !has(ps.Files, "b.go") || !ps.Buildable || ps.Err != nil {
+			t.Errorf("b on %v: Files = %q, Buildable = %v, Err = %v; want buildable from b.go", ps.Platform, ps.Files, ps.Buildable, ps.Err)
+		}
+	}
+
+	tests, err := mi.PlatformMatrix("testonly", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ps := range tests {
+		var nogo *NoGoError
+		if ps.Buildable || !errors.As(ps.Err, &nogo) {
+			t.Errorf("testonly on %v: Buildable = %v, Err = %v; want unbuildable with *NoGoError", ps.Platform, ps.Buildable, ps.Err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Tagreport reports the build tags used by the packages in a set of
+// module indexes.
+//
+// Usage:
+//
+//	tagreport [-custom] [-files] path...
+//
+// Each path is a module index file, or a directory that is searched for
+// module index files named go.index. For each tag, tagreport prints the
+// kind of tag, the number of files and packages using it, and, with
+// -files, the files themselves. Each file is listed by its package and
+// its name relative to its module root, since an index needn't be kept
+// next to its module. With -custom, only custom tags, which aren't GOOS,
+// GOARCH, release or toolchain tags, are reported.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/matloob/index"
+)
+
+var (
+	customOnly = flag.Bool("custom", false, "report only custom tags")
+	listFiles  = flag.Bool("files", false, "list the files using each tag")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tagreport [-custom] [-files] path...\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("tagreport: ")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	inv := index.NewTagInventory()
+	for _, arg := range flag.Args() {
+		files, err := indexFiles(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file := range files {
+			if err := addIndex(inv, file); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var usages []*index.TagUsage
+	for _, u := range inv.Tags() {
+		if !*customOnly || u.Kind == index.TagCustom {
+			usages = append(usages, u)
+		}
+	}
+
+	if *listFiles {
+		for _, u := range usages {
+			fmt.Printf("%s (%s): %d files in %d packages\n", u.Tag, u.Kind, len(u.Files), len(u.Packages))
+			for _, f := range u.ModuleFiles {
+				fmt.Printf("\t%s: %s\n", f.Package, f.Name)
+			}
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TAG\tKIND\tFILES\tPACKAGES\n")
+	for _, u := range usages {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", u.Tag, u.Kind, len(u.Files), len(u.Packages))
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// indexFiles returns the module index files named by path: path itself
+// if it is a file, or the files named go.index within it if it is a
+// directory.
+func indexFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() == "go.index" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func addIndex(inv *index.TagInventory, file string) error {
+	mi, err := index.Open(file, file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	defer mi.Close()
+	if err := inv.AddModule(mi); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package index
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PackageTags lists the build tags mentioned by a package's files.
+//
+// A file mentions the GOOS and GOARCH tags implied by its name, the tags
+// in its build constraints, and "cgo" if it imports "C". Unlike the
+// AllTags field of a build.Package, which holds the tags consulted while
+// evaluating the package for one build context, the tags mentioned don't
+// depend on the build context.
+type PackageTags struct {
+	All   []string            // tags mentioned by any file of the package, sorted
+	Files map[string][]string // tags mentioned by each file, sorted, by file name
+}
+
+// PackageTags returns the build tags mentioned by the files of the package
+// in dir, which is interpreted as by ImportPackage. Files whose names begin
+// with "_" or ".", which the go command ignores, mention no tags.
+func (mi *ModuleIndex) PackageTags(dir string) (*PackageTags, error) {
+	rp, ok, err := mi.RawPackage(dir)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, mi.notFoundError(dir)
+	}
+	return mi.packageTags(rp)
+}
+
+// packageTags returns the build tags mentioned by the files of rp.
+func (mi *ModuleIndex) packageTags(rp *RawPackage2) (*PackageTags, error) {
+	pt := &PackageTags{Files: make(map[string][]string)}
+	var all []string
+	for i := range rp.SourceFiles {
+		sf := &rp.SourceFiles[i]
+		name, err := sf.name()
+		if err != nil {
+			return nil, err
+		}
+		tags, err := sf.mentionedTags()
+		if err != nil {
+			return nil, err
+		}
+		pt.Files[name] = tags
+		all = append(all, tags...)
+	}
+	if mi.version >= Version7 {
+		pt.All = rp.allTags
+	} else {
+		pt.All = sortedUnique(all)
+	}
+	return pt, nil
+}
+
+// A TagKind classifies a build tag.
+type TagKind int
+
+const (
+	TagCustom    TagKind = iota // a tag set only by -tags or a build context's BuildTags
+	TagOS                       // a known GOOS value
+	TagArch                     // a known GOARCH value
+	TagRelease                  // a Go release tag, such as go1.18
+	TagToolchain                // cgo, a compiler name, or a GOEXPERIMENT tag
+)
+
+func (k TagKind) String() string {
+	switch k {
+	case TagCustom:
+		return "custom"
+	case TagOS:
+		return "os"
+	case TagArch:
+		return "arch"
+	case TagRelease:
+		return "release"
+	case TagToolchain:
+		return "toolchain"
+	}
+	return "TagKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// ClassifyTag reports what kind of build tag tag is.
+func ClassifyTag(tag string) TagKind {
+	switch {
+	case knownOS[tag]:
+		return TagOS
+	case knownArch[tag]:
+		return TagArch
+	case isReleaseTag(tag):
+		return TagRelease
+	case tag == "cgo" || tag == "gc" || tag == "gccgo" || strings.HasPrefix(tag, "goexperiment."):
+		return TagToolchain
+	}
+	return TagCustom
+}
+
+// isReleaseTag reports whether tag has the form go1.N.
+func isReleaseTag(tag string) bool {
+	minor := strings.TrimPrefix(tag, "go1.")
+	if minor == tag || minor == "" {
+		return false
+	}
+	for _, c := range minor {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// TagUsage describes where a build tag is used.
+type TagUsage struct {
+	Tag      string
+	Kind     TagKind
+	Files    []string // files mentioning the tag, sorted
+	Packages []string // packages with files mentioning the tag, sorted
+
+	// ModuleFiles lists the files mentioning the tag by package, sorted.
+	// Unlike Files, they don't depend on where the index was opened.
+	ModuleFiles []ModuleFile
+}
+
+// A ModuleFile identifies a file by its package and its name within the
+// package's module.
+type ModuleFile struct {
+	Package string // package, identified as in TagUsage.Packages
+	Name    string // slash-separated file name relative to the module root
+}
+
+// A TagInventory collects the build tags used by the packages of any
+// number of module indexes. Packages are identified by their import
+// paths, or by their directories if their module paths aren't known,
+// and files by their full paths.
+type TagInventory struct {
+	tags map[string]*TagUsage
+}
+
+// NewTagInventory returns an empty TagInventory.
+func NewTagInventory() *TagInventory {
+	return &TagInventory{tags: make(map[string]*TagUsage)}
+}
+
+// AddModule adds the tags used by every package in mi to the inventory.
+func (inv *TagInventory) AddModule(mi *ModuleIndex) error {
+	for _, dir := range mi.packageDirs() {
+		// Decode the package stored under dir directly rather than
+		// looking dir up again, which could find a different package,
+		// or none, if the index is corrupt.
+		rp, err := mi.rawPackage(mi.packages[dir])
+		if err != nil {
+			return err
+		}
+		pkg := rp.Path
+		if pkg == "." {
+			pkg = rp.SrcDir
+		}
+		pt, err := mi.packageTags(rp)
+		if err != nil {
+			return err
+		}
+		for name, tags := range pt.Files {
+			for _, tag := range tags {
+				u := inv.tags[tag]
+				if u == nil {
+					u = &TagUsage{Tag: tag, Kind: ClassifyTag(tag)}
+					inv.tags[tag] = u
+				}
+				u.Files = append(u.Files, filepath.Join(rp.SrcDir, name))
+				u.ModuleFiles = append(u.ModuleFiles, ModuleFile{Package: pkg, Name: path.Join(dir, name)})
+				if n := len(u.Packages); n == 0 || u.Packages[n-1] != pkg {
+					u.Packages = append(u.Packages, pkg)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Tags returns the usage of every tag in the inventory, sorted by tag.
+func (inv *TagInventory) Tags() []*TagUsage {
+	var usages []*TagUsage
+	for _, u := range inv.tags {
+		sort.Strings(u.Files)
+		sort.Slice(u.ModuleFiles, func(i, j int) bool {
+			fi, fj := u.ModuleFiles[i], u.ModuleFiles[j]
+			if fi.Package != fj.Package {
+				return fi.Package < fj.Package
+			}
+			return fi.Name < fj.Name
+		})
+		u.Packages = sortedUnique(u.Packages)
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Tag < usages[j].Tag })
+	return usages
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTagInventory(t *testing.T) {
+	moddir := t.TempDir()
+	writeTestModule(t, moddir)
+	mi := openTestIndex(t, encodeTestIndex(t, moddir, EncodeOptions{Version: CurrentVersion}), moddir)
+	inv := NewTagInventory()
+	if err := inv.AddModule(mi); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]TagUsage{
+		"bar":     {Kind: TagCustom, Files: []string{"a/tag.go"}, Packages: []string{"example.com/m/a"}},
+		"cgo":     {Kind: TagToolchain, Files: []string{"b/c.go"}, Packages: []string{"example.com/m/b"}},
+		"foo":     {Kind: TagCustom, Files: []string{"a/tag.go"}, Packages: []string{"example.com/m/a"}},
+		"linux":   {Kind: TagOS, Files: []string{"a/a_linux.go", "a/tag.go"}, Packages: []string{"example.com/m/a"}},
+		"windows": {Kind: TagOS, Files: []string{"a/plus.go"}, Packages: []string{"example.com/m/a"}},
+	}
+	for _, u := range inv.Tags() {
+		w, ok := want[u.Tag]
+		if !ok {
+			continue
+		}
+		var wantModuleFiles []ModuleFile
+		for i, f := range w.Files {
+			wantModuleFiles = append(wantModuleFiles, ModuleFile{Package: w.Packages[0], Name: f})
+			w.Files[i] = filepath.Join(moddir, filepath.FromSlash(f))
+		}
+		if u.Kind != w.Kind || fmt.Sprint(u.Files) != fmt.Sprint(w.Files) || fmt.Sprint(u.Packages) != fmt.Sprint(w.Packages) {
+			t.Errorf("tag %s: got %v %v %v, want %v %v %v", u.Tag, u.Kind, u.Files, u.Packages, w.Kind, w.Files, w.Packages)
+		}
+		if !reflect.DeepEqual(u.ModuleFiles, wantModuleFiles) {
+			t.Errorf("tag %s: ModuleFiles = %v, want %v", u.Tag, u.ModuleFiles, wantModuleFiles)
+		}
+		delete(want, u.Tag)
+	}
+	for tag := range want {
+		t.Errorf("tag %s missing from inventory", tag)
+	}
+}
@@ -36,295 +36,7 @@ func modVers(modcache string, path string) (module.Version, string, bool) {
 		version = rest[:sep]
 		pathInModule = filepath.ToSlash(rest[sep+1:])
 	}
-	return module.Version{modulePath, version}, pathInModule, true
-}
-
-var globalAllTags = []string{
-	"1.6",
-	"386",
-	"acceptance",
-	"acls",
-	"actions",
-	"addressscopes",
-	"admin",
-	"agents",
-	"aggregates",
-	"aix",
-	"allocations",
-	"alpha",
-	"amd64",
-	"amd64p32",
-	"android",
-	"appengine",
-	"appenginevm",
-	"arduino",
-	"arduino_mega2560",
-	"arduino_nano",
-	"arduino_nano33",
-	"arm",
-	"arm64",
-	"arm64be",
-	"armbe",
-	"atmega1284p",
-	"atsamd21",
-	"atsamd51",
-	"atsame5x",
-	"autocert",
-	"autogen",
-	"availabilityzones",
-	"avr",
-	"awsinclude",
-	"bad",
-	"baremetal",
-	"bench",
-	"blockstorage",
-	"bootfromvolume",
-	"bounds",
-	"capsules",
-	"cblas",
-	"cgo",
-	"circuitplay_express",
-	"claims",
-	"cluster_proxy",
-	"clustering",
-	"cmp_debug",
-	"codegen",
-	"complex_tests",
-	"compute",
-	"containerinfra",
-	"containers",
-	"cov",
-	"darwin",
-	"db",
-	"dbexamples",
-	"defsecrules",
-	"determine",
-	"dev",
-	"digispark",
-	"disable_events",
-	"disableunsafe",
-	"dns",
-	"dragonfly",
-	"easyjson_nounsafe",
-	"ebpf",
-	"events",
-	"example",
-	"exclude_disk_quota",
-	"exclude_graphdriver_aufs",
-	"exclude_graphdriver_btrfs",
-	"exclude_graphdriver_devicemapper",
-	"exclude_graphdriver_fuseoverlayfs",
-	"exclude_graphdriver_overlay",
-	"exclude_graphdriver_overlay2",
-	"exclude_graphdriver_zfs",
-	"extensions",
-	"fe310",
-	"feather_m4",
-	"feather_m4_can",
-	"feather_nrf52840",
-	"flavors",
-	"floatingips",
-	"fortran",
-	"freebsd",
-	"functional",
-	"fuzz",
-	"fwaas",
-	"gc",
-	"gccgo",
-	"generate",
-	"go.1.16",
-	"go1.1",
-	"go1.10",
-	"go1.11",
-	"go1.12",
-	"go1.13",
-	"go1.14",
-	"go1.15",
-	"go1.16",
-	"go1.17",
-	"go1.18",
-	"go1.2",
-	"go1.3",
-	"go1.4",
-	"go1.5",
-	"go1.6",
-	"go1.7",
-	"go1.8",
-	"go1.9",
-	"go18",
-	"godirwalk_debug",
-	"gofuzz",
-	"gofuzzbeta",
-	"golint",
-	"good",
-	"grpcgoid",
-	"have_btrfs",
-	"have_chainfs",
-	"here",
-	"hypervisors",
-	"i386",
-	"icu",
-	"identity",
-	"ignore",
-	"ignore_autogenerated",
-	"illumos",
-	"imageimport",
-	"images",
-	"imageservice",
-	"include_gcs",
-	"include_oss",
-	"integration",
-	"ios",
-	"journald",
-	"journald_compat",
-	"js",
-	"jsoniter",
-	"jsoniter_sloppy",
-	"k210",
-	"keymanager",
-	"keypairs",
-	"l7policies",
-	"layer3",
-	"lbaas",
-	"lbaas_v2",
-	"libdm_dlsym_deferred_remove",
-	"libdm_no_deferred_remove",
-	"libipmctl",
-	"libpfm",
-	"limits",
-	"linux",
-	"listeners",
-	"loadbalancer",
-	"loadbalancers",
-	"m68k",
-	"macnative",
-	"member",
-	"messages",
-	"messaging",
-	"metal",
-	"microbit",
-	"microbit_v2",
-	"mimxrt1062",
-	"mips",
-	"mips64",
-	"mips64le",
-	"mips64p32",
-	"mips64p32le",
-	"mips64x",
-	"mipsle",
-	"modhack",
-	"monitors",
-	"nacl",
-	"need",
-	"netbsd",
-	"networking",
-	"networkipavailabilities",
-	"nios2",
-	"no",
-	"no_btrfs",
-	"no_cri",
-	"no_lcow",
-	"noasm",
-	"nodes",
-	"none",
-	"nope",
-	"noresumabledigest",
-	"notravis",
-	"nrf51",
-	"nrf52",
-	"nrf52833",
-	"nrf52840",
-	"ok",
-	"one",
-	"openbsd",
-	"orders",
-	"p1am_100",
-	"panictest",
-	"perftest",
-	"plan9",
-	"policies",
-	"policytypes",
-	"pool",
-	"pools",
-	"ports",
-	"ppc",
-	"ppc64",
-	"ppc64le",
-	"ppc64x",
-	"profiletypes",
-	"protolegacy",
-	"protoreflect",
-	"provider",
-	"purego",
-	"pybadge",
-	"pygamer",
-	"pyportal",
-	"qtpy",
-	"queues",
-	"quotasets",
-	"race",
-	"recordsets",
-	"remoteconsoles",
-	"rescueunrescue",
-	"riscv",
-	"riscv64",
-	"roles",
-	"router",
-	"s390",
-	"s390x",
-	"s3crypto_integ",
-	"safe",
-	"seccomp",
-	"secgroups",
-	"secrets",
-	"security",
-	"servergroups",
-	"servers",
-	"services",
-	"sh",
-	"shbe",
-	"skip",
-	"solaris",
-	"something",
-	"sparc",
-	"sparc64",
-	"static_build",
-	"stm32f103xx",
-	"stm32f405",
-	"stm32f407",
-	"subnetpools",
-	"tag",
-	"tags",
-	"tasks",
-	"test",
-	"testcgo",
-	"three",
-	"tinygo",
-	"to",
-	"tomita",
-	"tools",
-	"trunks",
-	"two",
-	"typeparams",
-	"usage",
-	"v2v3",
-	"versions",
-	"vip",
-	"vlantransparent",
-	"volumeattach",
-	"vpnaas",
-	"wasm",
-	"we",
-	"weak_dependency",
-	"webhooks",
-	"which",
-	"windows",
-	"wioterminal",
-	"worse",
-	"x86",
-	"xtensa",
-	"zones",
-	"zos",
+	return module.Version{Path: modulePath, Version: version}, pathInModule, true
 }
 
 func main() {
@@ -358,6 +70,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if rm.Path == "" {
+			// The go command synthesizes a go.mod for modules without one.
+			rm.Path = modVers.Path
+		}
+		rm.Version = modVers.Version
 		indexfiledir := filepath.Join(tmpDir, modVers.String())
 		os.MkdirAll(indexfiledir, 755)
 		indexfilepath := filepath.Join(indexfiledir, "go.index")
@@ -386,9 +103,13 @@ func main() {
 			if !d.IsDir() {
 				return nil
 			}
+			// IndexModule skips the directories the go command
+			// ignores when matching "./...".
+			if name := d.Name(); path != dir && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
 
 			v, pkgpath, ok := modVers(modcache, path)
-			_ = pkgpath
 			if !ok {
 				return nil
 			}
@@ -398,6 +119,14 @@ func main() {
 			got, gotErr := modules[v].ImportPackage(ctx, path, 0)
 			// got, gotErr := getPackageRC(path)
 			want, wantErr := ctx.ImportDir(path, 0)
+			// In module mode, the go command reports the package's import
+			// path and module root rather than ImportDir's "." and no root.
+			want.ImportPath = modules[v].ModulePath()
+			want.Root = path
+			if pkgpath != "" {
+				want.ImportPath += "/" + pkgpath
+				want.Root = strings.TrimSuffix(path, string(filepath.Separator)+filepath.FromSlash(pkgpath))
+			}
 
 			if gotErr != nil || wantErr != nil {
 				if (gotErr == nil) != (wantErr == nil) || gotErr.Error() != wantErr.Error() {
@@ -439,12 +168,18 @@ func main() {
 	}
 
 	/*
-		var actualTags []string
+		inv := index.NewTagInventory()
+		for _, mi := range modules {
+			if err := inv.AddModule(mi); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		for _, tag := range globalAllTags {
-			if !knownOS[tag] && !knownArch[tag] && !strings.HasPrefix(tag, "go") {
+		var actualTags []string
+		for _, u := range inv.Tags() {
+			if u.Kind == index.TagCustom {
 				if rand.Intn(10) == 0 {
-					actualTags = append(actualTags, tag)
+					actualTags = append(actualTags, u.Tag)
 				}
 			}
 		}
@@ -533,15 +268,7 @@ func getContext(goos, goarch string, tags []string, cgo bool) build.Context {
 
 // Remove me... this is for tryitout.
 func WriteIndexRawModule(filepath string, rm *index.RawModule, moduleDir string) error {
-	var packages []*index.RawPackage
-	for _, m := range rm.Dirs {
-		packages = append(packages, m)
-	}
-	b, err := index.EncodeModule(packages, moduleDir)
-	if err != nil {
-		return err
-	}
 
 	fmt.Println("writing file", filepath)
-	return ioutil.WriteFile(filepath, b, 0644)
+	return index.WriteRawModule(filepath, rm, moduleDir, index.EncodeOptions{Version: index.CurrentVersion})
 }
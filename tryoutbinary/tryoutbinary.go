@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"go/build"
-	"io/ioutil"
 	"log"
 	"os"
 
@@ -37,14 +36,5 @@ func writeModulesTo(moduleDir string, outfile string) error {
 
 // Remove me... this is for tryitout.
 func WriteIndexRawModule(filepath string, rm *index.RawModule, moduleDir string) error {
-	var packages []*index.RawPackage
-	for _, m := range rm.Dirs {
-		packages = append(packages, m)
-	}
-	b, err := index.EncodeModule(packages, moduleDir)
-	if err != nil {
-		return err
-	}
-
-	return ioutil.WriteFile(filepath, b, 0644)
+	return index.WriteRawModule(filepath, rm, moduleDir, index.EncodeOptions{Version: index.CurrentVersion})
 }